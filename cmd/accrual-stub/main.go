@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/accrual/stub"
+)
+
+func main() {
+	var (
+		addr            string
+		processingAfter time.Duration
+		processedAfter  time.Duration
+		autoRegister    bool
+		autoAccrual     float64
+		rateLimit       int
+		retryAfter      time.Duration
+		failRate        float64
+		seed            int64
+	)
+
+	flag.StringVar(&addr, "a", "localhost:8085", "service address")
+	flag.DurationVar(&processingAfter, "processing-after", 2*time.Second, "time since registration after which an order is processing")
+	flag.DurationVar(&processedAfter, "processed-after", 5*time.Second, "time since registration after which an order is processed")
+	flag.BoolVar(&autoRegister, "auto-register", true, "register unknown orders on the first request instead of responding with 204")
+	flag.Float64Var(&autoAccrual, "auto-accrual", 100, "accrual of auto registered orders")
+	flag.IntVar(&rateLimit, "rate-limit", 0, "max number of order requests per minute, 0 for no limit")
+	flag.DurationVar(&retryAfter, "retry-after", 0, "Retry-After of 429 responses, time left till the end of the minute if not set")
+	flag.Float64Var(&failRate, "fail-rate", 0, "share of order requests failing with 500")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "random seed")
+	flag.Parse()
+
+	opts := []stub.Option{
+		stub.WithDelays(processingAfter, processedAfter),
+		stub.WithRateLimit(rateLimit, retryAfter),
+		stub.WithFailureRate(failRate),
+		stub.WithSeed(seed),
+	}
+
+	if autoRegister {
+		opts = append(opts, stub.WithAutoRegister(autoAccrual))
+	}
+
+	webSrv := &http.Server{Addr: addr, Handler: stub.New(opts...)}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	go func() {
+		call := <-sig
+
+		webSrv.Close()
+
+		fmt.Printf("graceful shutdown, got call: %v\n", call.String())
+	}()
+
+	err := webSrv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err.Error())
+	}
+}
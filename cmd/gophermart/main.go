@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -11,19 +12,91 @@ import (
 
 	"github.com/go-chi/chi"
 
+	"github.com/usa4ev/gophermart/internal/accrual"
 	"github.com/usa4ev/gophermart/internal/config"
+	"github.com/usa4ev/gophermart/internal/leader"
+	"github.com/usa4ev/gophermart/internal/orders"
 	"github.com/usa4ev/gophermart/internal/server"
+	"github.com/usa4ev/gophermart/internal/session"
 	"github.com/usa4ev/gophermart/internal/storage"
+	"github.com/usa4ev/gophermart/internal/storage/memstore"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err.Error())
+		}
+
+		return
+	}
+
 	cfg := config.New()
-	strg, err := storage.New(cfg.DatabaseDSN())
-	if err != nil {
+	if err := cfg.Validate(); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	srv := server.New(strg, cfg)
+	acc := accrual.New(cfg.AccrualSysAddr(),
+		accrual.WithTimeout(cfg.AccrualTimeout()),
+		accrual.WithBreaker(accrual.NewBreaker(cfg.AccrualBreakerThreshold(), cfg.AccrualBreakerCooldown())))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		strg        server.Storage
+		elector     server.Elector
+		electorDone = make(chan struct{})
+	)
+
+	if cfg.DatabaseDSN() != "" {
+		db, err := storage.New(cfg.DatabaseDSN())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		e := leader.New(db.DB, leader.DefaultKey, cfg.LeaderHeartbeat())
+
+		go func() {
+			defer close(electorDone)
+			e.Run(ctx)
+		}()
+
+		strg, elector = db, e
+	} else {
+		// a single replica keeping data in memory, e.g. to run locally without Postgres
+		log.Printf("database DSN is not set, data is kept in memory and lost on exit\n")
+
+		strg, elector = memstore.New(), leader.NewStandalone()
+		close(electorDone)
+	}
+
+	var validator orders.Validator = orders.Luhn{MaxLength: cfg.OrderNumberMaxLength()}
+
+	if cfg.OrderNumberPrefixes() != "" {
+		prefixes, err := orders.ParsePrefixes(cfg.OrderNumberPrefixes())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		validator = orders.All(validator, prefixes)
+	}
+
+	var keys *session.KeyRing
+
+	if cfg.JWTSecret() != "" || cfg.JWTKeys() != "" {
+		ring, err := session.LoadKeyRing(cfg.JWTSecret(), cfg.JWTKeys(), cfg.JWTActiveKey())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		keys = ring
+	} else {
+		log.Printf("session signing keys are not set, sessions are lost on exit and not shared with other replicas\n")
+
+		keys = session.NewEphemeralKeyRing()
+	}
+
+	srv := server.New(strg, acc, elector, cfg, server.WithOrderValidator(validator), server.WithKeyRing(keys))
 
 	r := newRouter(srv)
 	webSrv := &http.Server{Addr: cfg.RunAddress(), Handler: r}
@@ -41,7 +114,12 @@ func main() {
 	}()
 
 	// Run the server
-	err = webSrv.ListenAndServe()
+	err := webSrv.ListenAndServe()
+
+	// step down so another replica takes over right away
+	cancel()
+	<-electorDone
+
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err.Error())
 	}
@@ -56,19 +134,37 @@ func newRouter(srv server.Server) http.Handler {
 
 // POST /api/user/register — регистрация пользователя;
 // POST /api/user/login — аутентификация пользователя;
+// POST /api/user/token/refresh — обмен refresh-токена на новую пару токенов сессии;
+// POST /api/user/logout — завершение текущей сессии пользователя;
+// GET /api/user/sessions — получение списка активных сессий пользователя;
+// DELETE /api/user/sessions/{id} — завершение сессии пользователя или всех его сессий, кроме текущей (id = others);
 // POST /api/user/orders — загрузка пользователем номера заказа для расчёта;
 // GET /api/user/orders — получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях;
+// GET /api/user/orders/{number} — получение заказа пользователя с историей смены его статусов;
 // GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
 // POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
 // GET /api/user/balance/withdrawals — получение информации о выводе средств с накопительного счёта пользователем.
+// POST /api/internal/accrual/events — приём подписанных уведомлений о смене статуса заказа от системы начислений.
+// GET /api/admin/orders/stale — получение списка заказов, не обработанных системой начислений за отведённое время.
+// GET /api/admin/status — получение состояния фоновых процессов.
+// GET /.well-known/jwks.json — публичные ключи для проверки токенов сессий.
 func defaultRoute(srv server.Server) func(r chi.Router) {
 	return func(r chi.Router) {
 		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/register", http.HandlerFunc(srv.Register))
 		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/login", http.HandlerFunc(srv.Login))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodPost, "/api/user/orders", http.HandlerFunc(srv.StoreOrder))
+		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/token/refresh", http.HandlerFunc(srv.RefreshToken))
+		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodPost, "/api/user/logout", http.HandlerFunc(srv.Logout))
+		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/sessions", http.HandlerFunc(srv.LoadSessions))
+		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodDelete, "/api/user/sessions/{id}", http.HandlerFunc(srv.RevokeSession))
+		r.With(srv.GzipMW, srv.AuthorisationMW, srv.IdempotencyMW).Method(http.MethodPost, "/api/user/orders", http.HandlerFunc(srv.StoreOrder))
 		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/orders", http.HandlerFunc(srv.LoadOrders))
+		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/orders/{number}", http.HandlerFunc(srv.LoadOrder))
 		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/balance", http.HandlerFunc(srv.LoadBalance))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodPost, "/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
+		r.With(srv.GzipMW, srv.AuthorisationMW, srv.IdempotencyMW).Method(http.MethodPost, "/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
 		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/withdrawals", http.HandlerFunc(srv.LoadWithdrawals))
+		r.With(srv.AdminMW).Method(http.MethodGet, "/api/admin/orders/stale", http.HandlerFunc(srv.LoadStaleOrders))
+		r.Method(http.MethodPost, "/api/internal/accrual/events", http.HandlerFunc(srv.AccrualEvent))
+		r.With(srv.AdminMW).Method(http.MethodGet, "/api/admin/status", http.HandlerFunc(srv.Status))
+		r.Method(http.MethodGet, "/.well-known/jwks.json", http.HandlerFunc(srv.JWKS))
 	}
 }
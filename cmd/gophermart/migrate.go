@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/usa4ev/gophermart/internal/config"
+	"github.com/usa4ev/gophermart/internal/storage/migrate"
+)
+
+// runMigrate handles "gophermart migrate up|down [steps]|status"
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dsn := fs.String("d", config.New(config.IgnoreOsArgs()).DatabaseDSN(), "database connection string")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gophermart migrate [-d dsn] up|down [steps]|status\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+
+		return fmt.Errorf("migrate action is not specified")
+	}
+
+	db, err := sql.Open("pgx", *dsn)
+	if err != nil {
+		return fmt.Errorf("cannot connect to Database: %w", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "up":
+		return migrate.Up(ctx, db)
+	case "down":
+		steps := 1
+
+		if fs.NArg() > 1 {
+			steps, err = strconv.Atoi(fs.Arg(1))
+			if err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number: %v", fs.Arg(1))
+			}
+		}
+
+		return migrate.Down(ctx, db, steps)
+	case "status":
+		statuses, err := migrate.List(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Fprintf(w, "%04d\t%v\t%v\n", s.Version, s.Name, appliedAt)
+		}
+
+		return w.Flush()
+	default:
+		fs.Usage()
+
+		return fmt.Errorf("unknown migrate action: %v", fs.Arg(0))
+	}
+}
@@ -0,0 +1,220 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+// defaultRetryAfter is used when the accrual system does not tell for how long to hold requests
+const defaultRetryAfter = time.Minute
+
+type (
+	// Client requests order statuses from the accrual system
+	Client struct {
+		httpClient *http.Client
+		baseURL    string
+		limiter    *Limiter
+		breaker    *Breaker
+		timeout    time.Duration
+	}
+
+	clientOption func(c *Client)
+)
+
+// WithHTTPClient sets http client used to access the accrual system
+func WithHTTPClient(httpClient *http.Client) clientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithLimiter sets a Limiter shared by the Client with other consumers
+func WithLimiter(limiter *Limiter) clientOption {
+	return func(c *Client) {
+		c.limiter = limiter
+	}
+}
+
+// WithBreaker sets a Breaker suspending requests while the accrual system fails
+func WithBreaker(breaker *Breaker) clientOption {
+	return func(c *Client) {
+		c.breaker = breaker
+	}
+}
+
+// WithTimeout limits time of every request to the accrual system.
+// Time spent waiting for the Limiter is not counted.
+func WithTimeout(timeout time.Duration) clientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// New returns a Client for the accrual system found at baseURL
+func New(baseURL string, opts ...clientOption) *Client {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+
+	c := &Client{
+		httpClient: http.DefaultClient,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.limiter == nil {
+		c.limiter = NewLimiter(0)
+	}
+
+	if c.breaker == nil {
+		c.breaker = NewBreaker(0, 0)
+	}
+
+	return c
+}
+
+// Limiter returns the Limiter the Client waits for before each request
+func (c *Client) Limiter() *Limiter {
+	return c.limiter
+}
+
+// BreakerState returns state of the circuit breaker guarding the accrual system
+func (c *Client) BreakerState() BreakerState {
+	return c.breaker.State()
+}
+
+// OrderStatus returns accrual status of the order.
+// ErrOrderNotRegistered is returned if the accrual system does not know the order,
+// RateLimitError if requests are limited, ErrInternal if the accrual system failed
+// and ErrCircuitOpen if requests are suspended after repeated failures.
+func (c *Client) OrderStatus(ctx context.Context, number string) (orders.Status, error) {
+	if err := c.breaker.Allow(); err != nil {
+		return orders.Status{}, err
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		c.breaker.Abort()
+
+		return orders.Status{}, err
+	}
+
+	status, err := c.orderStatus(ctx, number)
+
+	var rlErr *RateLimitError
+
+	switch {
+	case err == nil, errors.Is(err, ErrOrderNotRegistered), errors.As(err, &rlErr):
+		c.breaker.Success()
+	case errors.Is(err, context.Canceled):
+		c.breaker.Abort()
+	default:
+		c.breaker.Failure(err)
+	}
+
+	return status, err
+}
+
+func (c *Client) orderStatus(ctx context.Context, number string) (orders.Status, error) {
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(number), nil)
+	if err != nil {
+		return orders.Status{}, fmt.Errorf("failed to build accrual system request: %w", err)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return orders.Status{}, fmt.Errorf("failed to access accrual system: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		status := orders.Status{}
+
+		dec := json.NewDecoder(res.Body)
+		if err := dec.Decode(&status); err != nil {
+			return orders.Status{}, fmt.Errorf("failed to decode response of the accrual system: %w", err)
+		}
+
+		return status, nil
+	case http.StatusNoContent:
+		return orders.Status{}, ErrOrderNotRegistered
+	case http.StatusTooManyRequests:
+		return orders.Status{}, c.throttle(res)
+	case http.StatusInternalServerError:
+		body, _ := io.ReadAll(res.Body)
+
+		return orders.Status{}, fmt.Errorf("%w: %v", ErrInternal, strings.TrimSpace(string(body)))
+	default:
+		body, _ := io.ReadAll(res.Body)
+
+		return orders.Status{}, &UnexpectedStatusError{Code: res.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+}
+
+// throttle pauses the limiter according to 429 response and returns RateLimitError
+func (c *Client) throttle(res *http.Response) error {
+	rlErr := &RateLimitError{RetryAt: time.Now().Add(parseRetryAfter(res.Header.Get("Retry-After")))}
+
+	body, err := io.ReadAll(res.Body)
+	if err == nil {
+		rlErr.Limit = parseLimit(string(body))
+	}
+
+	c.limiter.SetLimit(rlErr.Limit)
+	c.limiter.Pause(rlErr.RetryAt)
+
+	return rlErr
+}
+
+// parseRetryAfter parses Retry-After header given either in seconds or as HTTP date
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+
+		return 0
+	}
+
+	return defaultRetryAfter
+}
+
+// parseLimit gets the number of requests per minute from 429 response message
+func parseLimit(message string) int {
+	var limit int
+
+	_, err := fmt.Sscanf(strings.TrimSpace(message), "No more than %d requests per minute allowed", &limit)
+	if err != nil {
+		return 0
+	}
+
+	return limit
+}
@@ -0,0 +1,197 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/money"
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+func TestOrderStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		header     map[string]string
+		body       string
+		want       orders.Status
+		wantErr    error
+		wantLimit  int
+		wantRetry  time.Duration
+		rateLimits bool
+	}{
+		{
+			name: "processed",
+			code: http.StatusOK,
+			body: `{"order":"12345678903","status":"PROCESSED","accrual":500}`,
+			want: orders.Status{Order: "12345678903", Status: "PROCESSED", Accrual: money.Points(500)},
+		},
+		{
+			name:    "not registered",
+			code:    http.StatusNoContent,
+			wantErr: ErrOrderNotRegistered,
+		},
+		{
+			name:    "internal error",
+			code:    http.StatusInternalServerError,
+			body:    "boom",
+			wantErr: ErrInternal,
+		},
+		{
+			name:       "too many requests",
+			code:       http.StatusTooManyRequests,
+			header:     map[string]string{"Retry-After": "60"},
+			body:       "No more than 10 requests per minute allowed",
+			wantLimit:  10,
+			wantRetry:  time.Minute,
+			rateLimits: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/orders/12345678903", r.URL.Path)
+
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			c := New(ts.URL, WithHTTPClient(ts.Client()))
+
+			got, err := c.OrderStatus(context.Background(), "12345678903")
+
+			if tt.rateLimits {
+				var rlErr *RateLimitError
+				require.True(t, errors.As(err, &rlErr), "expected RateLimitError, got %v", err)
+				assert.Equal(t, tt.wantLimit, rlErr.Limit)
+				assert.WithinDuration(t, time.Now().Add(tt.wantRetry), rlErr.RetryAt, time.Second)
+				assert.Equal(t, rlErr.RetryAt, c.Limiter().PausedUntil())
+
+				return
+			}
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	t.Run("pause holds requests", func(t *testing.T) {
+		l := NewLimiter(0)
+		l.Pause(time.Now().Add(time.Hour))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err := l.Wait(ctx)
+
+		var rlErr *RateLimitError
+		assert.True(t, errors.As(err, &rlErr), "expected RateLimitError, got %v", err)
+	})
+
+	t.Run("pause is lifted", func(t *testing.T) {
+		l := NewLimiter(0)
+		l.Pause(time.Now().Add(100 * time.Millisecond))
+
+		start := time.Now()
+		require.NoError(t, l.Wait(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	})
+
+	t.Run("limit per minute", func(t *testing.T) {
+		l := NewLimiter(2)
+
+		require.NoError(t, l.Wait(context.Background()))
+		require.NoError(t, l.Wait(context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+	assert.Equal(t, defaultRetryAfter, parseRetryAfter(""))
+	assert.InDelta(t, float64(2*time.Minute), float64(parseRetryAfter(time.Now().Add(2*time.Minute).UTC().Format(http.TimeFormat))), float64(time.Second))
+}
+
+func TestBreaker(t *testing.T) {
+	fail := true
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Write([]byte(`{"order":"12345678903","status":"PROCESSING"}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithHTTPClient(ts.Client()), WithBreaker(NewBreaker(3, 100*time.Millisecond)))
+
+	for i := 0; i < 3; i++ {
+		_, err := c.OrderStatus(context.Background(), "12345678903")
+		require.ErrorIs(t, err, ErrInternal)
+	}
+
+	assert.Equal(t, StateOpen, c.BreakerState().State)
+
+	_, err := c.OrderStatus(context.Background(), "12345678903")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// failed probe opens the breaker again
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = c.OrderStatus(context.Background(), "12345678903")
+	require.ErrorIs(t, err, ErrInternal)
+	assert.Equal(t, StateOpen, c.BreakerState().State)
+
+	// successful probe closes the breaker
+	time.Sleep(100 * time.Millisecond)
+
+	fail = false
+
+	_, err = c.OrderStatus(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, StateClosed, c.BreakerState().State)
+	assert.Equal(t, 0, c.BreakerState().Failures)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := NewBreaker(1, 0)
+
+	require.NoError(t, b.Allow())
+	b.Failure(ErrInternal)
+
+	// a single probe is let through
+	require.NoError(t, b.Allow())
+	assert.Equal(t, StateHalfOpen, b.State().State)
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	b.Abort()
+	require.NoError(t, b.Allow())
+}
@@ -0,0 +1,36 @@
+package accrual
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	ErrOrderNotRegistered = fmt.Errorf("order is not registered in accrual system")
+	ErrInternal           = fmt.Errorf("accrual system internal error")
+	ErrCircuitOpen        = fmt.Errorf("accrual system requests are suspended after repeated failures")
+)
+
+// RateLimitError is returned when the accrual system refuses a request
+// because the rate limit is exceeded. RetryAt is the moment the limit is lifted,
+// Limit is the number of requests per minute advertised by the accrual system
+// or zero if it could not be parsed.
+type RateLimitError struct {
+	RetryAt time.Time
+	Limit   int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit exceeded, retry at %v", e.RetryAt.Format(time.RFC3339))
+}
+
+// UnexpectedStatusError is returned when the accrual system responds with a code
+// not described by the specification
+type UnexpectedStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected response from accrual system. code: %v message: %v", e.Code, e.Body)
+}
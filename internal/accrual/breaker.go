@@ -0,0 +1,126 @@
+package accrual
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+type (
+	// Breaker stops requests to the accrual system after threshold consecutive failures.
+	// Once cooldown passes a single probe request is let through:
+	// the breaker closes if it succeeds and opens again otherwise.
+	Breaker struct {
+		mu        sync.Mutex
+		threshold int
+		cooldown  time.Duration
+		state     string
+		failures  int
+		since     time.Time
+		probing   bool
+		lastErr   string
+	}
+
+	// BreakerState describes the Breaker for operators
+	BreakerState struct {
+		State     string    `json:"state"`
+		Failures  int       `json:"failures"`
+		Since     time.Time `json:"since"`
+		LastError string    `json:"last_error,omitempty"`
+	}
+)
+
+// NewBreaker returns a closed Breaker. Zero threshold disables the Breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: StateClosed, since: time.Now()}
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent.
+// A request allowed must be followed by Success, Failure or Abort call.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.since) < b.cooldown {
+			return ErrCircuitOpen
+		}
+
+		b.transit(StateHalfOpen)
+		b.probing = true
+
+		return nil
+	case StateHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+
+		b.probing = true
+
+		return nil
+	}
+
+	return nil
+}
+
+// Success reports the accrual system responded properly
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+
+	if b.state != StateClosed {
+		b.transit(StateClosed)
+	}
+}
+
+// Failure reports the accrual system failed to respond
+func (b *Breaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	b.lastErr = err.Error()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	if b.state == StateHalfOpen || (b.state == StateClosed && b.failures >= b.threshold) {
+		b.transit(StateOpen)
+	}
+}
+
+// Abort reports the request was cancelled before the accrual system responded
+func (b *Breaker) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// State returns current state of the Breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerState{State: b.state, Failures: b.failures, Since: b.since, LastError: b.lastErr}
+}
+
+func (b *Breaker) transit(state string) {
+	log.Printf("accrual system circuit breaker: %v -> %v after %v consecutive failures, last error: %v\n",
+		b.state, state, b.failures, b.lastErr)
+
+	b.state = state
+	b.since = time.Now()
+}
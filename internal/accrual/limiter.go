@@ -0,0 +1,119 @@
+package accrual
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by all the requests to the accrual system.
+// It allows no more than the advertised number of requests per minute
+// and holds every request until the Retry-After deadline once the limit is hit.
+type Limiter struct {
+	mu          sync.Mutex
+	perMinute   int
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewLimiter returns a Limiter allowing perMinute requests per minute.
+// Zero means no limit until the accrual system advertises one.
+func NewLimiter(perMinute int) *Limiter {
+	return &Limiter{perMinute: perMinute, tokens: float64(perMinute), last: time.Now()}
+}
+
+// Wait blocks until a request is allowed or ctx is done.
+// If ctx expires before the pause is lifted Wait returns RateLimitError right away.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		delay, err := l.reserve(ctx)
+		if err != nil || delay == 0 {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token if there is one or returns time to wait for the next one
+func (l *Limiter) reserve(ctx context.Context) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Before(l.pausedUntil) {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(l.pausedUntil) {
+			return 0, &RateLimitError{RetryAt: l.pausedUntil, Limit: l.perMinute}
+		}
+
+		return l.pausedUntil.Sub(now), nil
+	}
+
+	if l.perMinute <= 0 {
+		return 0, nil
+	}
+
+	rate := float64(l.perMinute) / float64(time.Minute)
+
+	l.tokens += float64(now.Sub(l.last)) * rate
+	if l.tokens > float64(l.perMinute) {
+		l.tokens = float64(l.perMinute)
+	}
+
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+
+		return 0, nil
+	}
+
+	return time.Duration((1 - l.tokens) / rate), nil
+}
+
+// Pause holds all requests until the given moment.
+// The bucket is refilled when the pause is over as the accrual system starts a new window.
+func (l *Limiter) Pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+		l.tokens = float64(l.perMinute)
+		l.last = until
+	}
+}
+
+// SetLimit adapts the Limiter to the number of requests per minute advertised by the accrual system
+func (l *Limiter) SetLimit(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if perMinute <= 0 || perMinute == l.perMinute {
+		return
+	}
+
+	l.perMinute = perMinute
+
+	if l.tokens > float64(perMinute) {
+		l.tokens = float64(perMinute)
+	}
+}
+
+// PausedUntil returns the moment requests are held until
+func (l *Limiter) PausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.pausedUntil
+}
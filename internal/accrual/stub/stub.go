@@ -0,0 +1,355 @@
+// Package stub simulates the accrual system for development and tests
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+type (
+	// Server implements accrual system API.
+	// Registered orders are REGISTERED until processing delay passes, then PROCESSING
+	// until processed delay passes, then either PROCESSED with accrual calculated
+	// by the reward rules or INVALID if no rule matches their goods.
+	Server struct {
+		mu     sync.Mutex
+		router http.Handler
+		orders map[string]*order
+		rules  []Rule
+		rnd    *rand.Rand
+		now    func() time.Time
+
+		processingAfter time.Duration
+		processedAfter  time.Duration
+		autoRegister    bool
+		autoAccrual     float64
+		invalid         map[string]bool
+		failRate        float64
+
+		rateLimit   int
+		retryAfter  time.Duration
+		windowStart time.Time
+		windowCount int
+	}
+
+	Good struct {
+		Description string  `json:"description"`
+		Price       float64 `json:"price"`
+	}
+
+	Rule struct {
+		Match      string  `json:"match"`
+		Reward     float64 `json:"reward"`
+		RewardType string  `json:"reward_type"`
+	}
+
+	order struct {
+		registeredAt time.Time
+		goods        []Good
+		// accrual is set for auto registered orders instead of calculating by the rules
+		accrual *float64
+	}
+
+	registration struct {
+		Order string `json:"order"`
+		Goods []Good `json:"goods"`
+	}
+
+	response struct {
+		Order   string  `json:"order"`
+		Status  string  `json:"status"`
+		Accrual float64 `json:"accrual,omitempty"`
+	}
+
+	// Option configures the Server
+	Option func(s *Server)
+)
+
+// WithDelays sets time since registration after which orders are processing and processed
+func WithDelays(processingAfter, processedAfter time.Duration) Option {
+	return func(s *Server) {
+		s.processingAfter = processingAfter
+		s.processedAfter = processedAfter
+	}
+}
+
+// WithAutoRegister registers unknown orders on the first request with the given accrual
+// instead of responding with 204
+func WithAutoRegister(accrual float64) Option {
+	return func(s *Server) {
+		s.autoRegister = true
+		s.autoAccrual = accrual
+	}
+}
+
+// WithInvalidOrders makes the orders INVALID once processed regardless of their goods
+func WithInvalidOrders(numbers ...string) Option {
+	return func(s *Server) {
+		for _, number := range numbers {
+			s.invalid[number] = true
+		}
+	}
+}
+
+// WithRateLimit allows no more than perMinute order requests per minute,
+// the rest are answered with 429 and Retry-After header.
+// retryAfter is used instead of time left till the end of the minute if set.
+func WithRateLimit(perMinute int, retryAfter time.Duration) Option {
+	return func(s *Server) {
+		s.rateLimit = perMinute
+		s.retryAfter = retryAfter
+	}
+}
+
+// WithFailureRate makes the given share of order requests fail with 500
+func WithFailureRate(rate float64) Option {
+	return func(s *Server) {
+		s.failRate = rate
+	}
+}
+
+// WithSeed seeds random failures to make them reproducible
+func WithSeed(seed int64) Option {
+	return func(s *Server) {
+		s.rnd = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithClock replaces the time source used for status transitions and rate limiting
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// WithRules registers reward rules on start
+func WithRules(rules ...Rule) Option {
+	return func(s *Server) {
+		s.rules = append(s.rules, rules...)
+	}
+}
+
+// New returns a Server processing orders instantly until configured otherwise
+func New(opts ...Option) *Server {
+	s := &Server{
+		orders:  make(map[string]*order),
+		invalid: make(map[string]bool),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:     time.Now,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", s.OrderStatus)
+	r.Post("/api/orders", s.RegisterOrder)
+	r.Post("/api/goods", s.RegisterRule)
+
+	s.router = r
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// OrderStatus handler returns current status of the order
+func (s *Server) OrderStatus(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if s.rateLimit > 0 {
+		if now.Sub(s.windowStart) >= time.Minute {
+			s.windowStart = now
+			s.windowCount = 0
+		}
+
+		s.windowCount++
+
+		if s.windowCount > s.rateLimit {
+			retryAfter := s.retryAfter
+			if retryAfter == 0 {
+				retryAfter = s.windowStart.Add(time.Minute).Sub(now)
+			}
+
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "No more than %d requests per minute allowed", s.rateLimit)
+
+			return
+		}
+	}
+
+	if s.failRate > 0 && s.rnd.Float64() < s.failRate {
+		http.Error(w, "simulated failure", http.StatusInternalServerError)
+
+		return
+	}
+
+	o, ok := s.orders[number]
+	if !ok {
+		if !s.autoRegister {
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		accrual := s.autoAccrual
+		o = &order{registeredAt: now, accrual: &accrual}
+		s.orders[number] = o
+	}
+
+	res := s.status(number, o, now)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// status returns the state of the order at the given moment
+func (s *Server) status(number string, o *order, now time.Time) response {
+	elapsed := now.Sub(o.registeredAt)
+
+	switch {
+	case elapsed < s.processingAfter:
+		return response{Order: number, Status: StatusRegistered}
+	case elapsed < s.processedAfter:
+		return response{Order: number, Status: StatusProcessing}
+	case s.invalid[number]:
+		return response{Order: number, Status: StatusInvalid}
+	case o.accrual != nil:
+		return response{Order: number, Status: StatusProcessed, Accrual: *o.accrual}
+	}
+
+	accrual, matched := s.calculate(o.goods)
+	if !matched {
+		return response{Order: number, Status: StatusInvalid}
+	}
+
+	return response{Order: number, Status: StatusProcessed, Accrual: accrual}
+}
+
+// calculate sums up rewards for the goods by the first matching rule of each good
+func (s *Server) calculate(goods []Good) (float64, bool) {
+	var (
+		accrual float64
+		matched bool
+	)
+
+	for _, good := range goods {
+		for _, rule := range s.rules {
+			if !strings.Contains(good.Description, rule.Match) {
+				continue
+			}
+
+			matched = true
+
+			if rule.RewardType == RewardPercent {
+				accrual += good.Price * rule.Reward / 100
+			} else {
+				accrual += rule.Reward
+			}
+
+			break
+		}
+	}
+
+	return math.Round(accrual*100) / 100, matched
+}
+
+// RegisterOrder handler registers a new order with its goods
+func (s *Server) RegisterOrder(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	reg := registration{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reg); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode a message: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if !orders.OrderNumValid(reg.Order) {
+		http.Error(w, "invalid order number", http.StatusBadRequest)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[reg.Order]; ok {
+		http.Error(w, "order is already registered", http.StatusConflict)
+
+		return
+	}
+
+	s.orders[reg.Order] = &order{registeredAt: s.now(), goods: reg.Goods}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RegisterRule handler adds a new reward rule
+func (s *Server) RegisterRule(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	rule := Rule{}
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&rule); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode a message: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if rule.Match == "" || rule.Reward < 0 || (rule.RewardType != RewardPercent && rule.RewardType != RewardPoints) {
+		http.Error(w, "invalid reward rule", http.StatusBadRequest)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.rules {
+		if existing.Match == rule.Match {
+			http.Error(w, "reward rule is already registered", http.StatusConflict)
+
+			return
+		}
+	}
+
+	s.rules = append(s.rules, rule)
+}
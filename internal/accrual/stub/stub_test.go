@@ -0,0 +1,146 @@
+package stub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/money"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func post(t *testing.T, ts *httptest.Server, path, body string) int {
+	res, err := ts.Client().Post(ts.URL+path, "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestTransitions(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+
+	ts := httptest.NewServer(New(WithDelays(time.Second, 2*time.Second), WithClock(clock.Now)))
+	defer ts.Close()
+
+	cl := accrual.New(ts.URL, accrual.WithHTTPClient(ts.Client()))
+
+	assert.Equal(t, http.StatusOK, post(t, ts, "/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`))
+	assert.Equal(t, http.StatusOK, post(t, ts, "/api/goods", `{"match":"Tefal","reward":15,"reward_type":"pt"}`))
+	assert.Equal(t, http.StatusConflict, post(t, ts, "/api/goods", `{"match":"Bork","reward":5,"reward_type":"pt"}`))
+	assert.Equal(t, http.StatusBadRequest, post(t, ts, "/api/goods", `{"match":"Philips","reward":5,"reward_type":"usd"}`))
+
+	assert.Equal(t, http.StatusAccepted, post(t, ts, "/api/orders",
+		`{"order":"12345678903","goods":[{"description":"Чайник Bork","price":7000},{"description":"Сковорода Tefal","price":1000}]}`))
+	assert.Equal(t, http.StatusAccepted, post(t, ts, "/api/orders",
+		`{"order":"2377225624","goods":[{"description":"Утюг Philips","price":3000}]}`))
+	assert.Equal(t, http.StatusConflict, post(t, ts, "/api/orders", `{"order":"12345678903","goods":[]}`))
+	assert.Equal(t, http.StatusBadRequest, post(t, ts, "/api/orders", `{"order":"12345678904","goods":[]}`))
+
+	status, err := cl.OrderStatus(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, StatusRegistered, status.Status)
+
+	clock.Add(time.Second)
+
+	status, err = cl.OrderStatus(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, status.Status)
+
+	clock.Add(time.Second)
+
+	status, err = cl.OrderStatus(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessed, status.Status)
+	assert.Equal(t, money.Points(715), status.Accrual)
+
+	// no rule matches
+	status, err = cl.OrderStatus(context.Background(), "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, StatusInvalid, status.Status)
+
+	_, err = cl.OrderStatus(context.Background(), "79927398713")
+	assert.ErrorIs(t, err, accrual.ErrOrderNotRegistered)
+}
+
+func TestScenarios(t *testing.T) {
+	t.Run("auto register", func(t *testing.T) {
+		ts := httptest.NewServer(New(WithAutoRegister(100), WithInvalidOrders("2377225624")))
+		defer ts.Close()
+
+		cl := accrual.New(ts.URL, accrual.WithHTTPClient(ts.Client()))
+
+		status, err := cl.OrderStatus(context.Background(), "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, StatusProcessed, status.Status)
+		assert.Equal(t, money.Points(100), status.Accrual)
+
+		status, err = cl.OrderStatus(context.Background(), "2377225624")
+		require.NoError(t, err)
+		assert.Equal(t, StatusInvalid, status.Status)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		ts := httptest.NewServer(New(WithAutoRegister(100), WithRateLimit(2, 30*time.Second)))
+		defer ts.Close()
+
+		cl := accrual.New(ts.URL, accrual.WithHTTPClient(ts.Client()))
+
+		for i := 0; i < 2; i++ {
+			_, err := cl.OrderStatus(context.Background(), "12345678903")
+			require.NoError(t, err)
+		}
+
+		_, err := cl.OrderStatus(context.Background(), "12345678903")
+
+		var rlErr *accrual.RateLimitError
+		require.True(t, errors.As(err, &rlErr), "expected RateLimitError, got %v", err)
+		assert.Equal(t, 2, rlErr.Limit)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), rlErr.RetryAt, time.Second)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		ts := httptest.NewServer(New(WithAutoRegister(100), WithFailureRate(0.5), WithSeed(1)))
+		defer ts.Close()
+
+		cl := accrual.New(ts.URL, accrual.WithHTTPClient(ts.Client()))
+
+		failed := 0
+		for i := 0; i < 100; i++ {
+			_, err := cl.OrderStatus(context.Background(), "12345678903")
+			if errors.Is(err, accrual.ErrInternal) {
+				failed++
+			}
+		}
+
+		assert.Greater(t, failed, 25)
+		assert.Less(t, failed, 75)
+	})
+}
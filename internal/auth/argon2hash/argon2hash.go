@@ -43,7 +43,7 @@ func GenerateFromPassword(password string, p Params) (string, error) {
 	b64salt := base64.RawStdEncoding.EncodeToString(salt)
 	b64hash := base64.RawStdEncoding.EncodeToString(hash)
 
-	return fmt.Sprintf("$argon2id$v=%v$m=%d,t=%d,p=%o$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64salt, b64hash),
+	return fmt.Sprintf("$argon2id$v=%v$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism, b64salt, b64hash),
 		nil
 }
 
@@ -106,6 +106,17 @@ func parseHash(encodedHash string) (p *Params, salt, hash []byte, err error) {
 	return p, salt, hash, nil
 }
 
+// NeedsRehash returns true if any of the hash parameters is weaker than the given ones
+func NeedsRehash(encodedHash string, p Params) (bool, error) {
+	hp, _, _, err := parseHash(encodedHash)
+	if err != nil {
+		return false, err
+	}
+
+	return hp.Memory < p.Memory || hp.Iterations < p.Iterations || hp.Parallelism < p.Parallelism ||
+		hp.SaltLength < p.SaltLength || hp.KeyLength < p.KeyLength, nil
+}
+
 func ComparePasswordAndHash(password, encodedHash string) (match bool, err error) {
 	p, salt, hash, err := parseHash(encodedHash)
 	if err != nil {
@@ -33,3 +33,52 @@ func TestComparePasswordAndHash(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateFromPasswordParams(t *testing.T) {
+	// parallelism of 8 and more used to be formatted in octal
+	for _, parallelism := range []uint8{1, 8, 10} {
+		p := Params{Memory: 1024, Iterations: 1, Parallelism: parallelism, SaltLength: 16, KeyLength: 32}
+
+		hash, err := GenerateFromPassword("qwerty12345", p)
+		require.NoError(t, err)
+
+		got, _, _, err := parseHash(hash)
+		require.NoError(t, err)
+		assert.Equal(t, p, *got)
+
+		ok, err := ComparePasswordAndHash("qwerty12345", hash)
+		require.NoError(t, err)
+		assert.True(t, ok, "passwords don't match with parallelism %v", parallelism)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	p := Params{Memory: 1024, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+
+	hash, err := GenerateFromPassword("qwerty12345", p)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		policy Params
+		want   bool
+	}{
+		{name: "same", policy: p, want: false},
+		{name: "weaker policy", policy: Params{Memory: 512, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16}, want: false},
+		{name: "more memory", policy: Params{Memory: 2048, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 32}, want: true},
+		{name: "more iterations", policy: Params{Memory: 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}, want: true},
+		{name: "more parallelism", policy: Params{Memory: 1024, Iterations: 2, Parallelism: 4, SaltLength: 16, KeyLength: 32}, want: true},
+		{name: "longer key", policy: Params{Memory: 1024, Iterations: 2, Parallelism: 2, SaltLength: 16, KeyLength: 64}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NeedsRehash(hash, tt.policy)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = NeedsRehash("not a hash", p)
+	assert.ErrorIs(t, err, ErrInvalidHash)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 
 	"github.com/usa4ev/gophermart/internal/auth/argon2hash"
 )
@@ -11,6 +12,7 @@ import (
 type (
 	passwordGetter interface {
 		GetPasswordHash(cxt context.Context, userName string) (string, string, error)
+		UpdatePasswordHash(ctx context.Context, userID, hash string) error
 	}
 )
 
@@ -52,7 +54,9 @@ type (
 //	})
 //}
 
-func Login(ctx context.Context, userName, password string, p passwordGetter) (string, error) {
+// Login checks the password of the user and returns the user ID.
+// A hash with parameters weaker than the given ones is replaced with a new one.
+func Login(ctx context.Context, userName, password string, params argon2hash.Params, p passwordGetter) (string, error) {
 	userID, pwdHash, err := p.GetPasswordHash(ctx, userName)
 	if err != nil {
 		return "", err
@@ -69,9 +73,28 @@ func Login(ctx context.Context, userName, password string, p passwordGetter) (st
 		return "", ErrUnathorized
 	}
 
+	// the password is known only now, so it is the only chance to upgrade the hash
+	if err := rehash(ctx, userID, password, pwdHash, params, p); err != nil {
+		log.Printf("failed to upgrade password hash of user %v: %v\n", userID, err)
+	}
+
 	return userID, nil
 }
 
+func rehash(ctx context.Context, userID, password, pwdHash string, params argon2hash.Params, p passwordGetter) error {
+	weak, err := argon2hash.NeedsRehash(pwdHash, params)
+	if err != nil || !weak {
+		return err
+	}
+
+	hash, err := argon2hash.GenerateFromPassword(password, params)
+	if err != nil {
+		return err
+	}
+
+	return p.UpdatePasswordHash(ctx, userID, hash)
+}
+
 type (
 	UserCheckAdder interface {
 		AddUser(ctx context.Context, username, hash string) (string, error)
@@ -79,7 +102,7 @@ type (
 	}
 )
 
-func RegisterUser(ctx context.Context, userName, password string, ua UserCheckAdder) (string, error) {
+func RegisterUser(ctx context.Context, userName, password string, params argon2hash.Params, ua UserCheckAdder) (string, error) {
 	err := validateUserName(ctx, userName, ua)
 	if err != nil {
 		if errors.Is(err, ErrUserAlreadyExists) {
@@ -89,7 +112,7 @@ func RegisterUser(ctx context.Context, userName, password string, ua UserCheckAd
 		return "", err
 	}
 
-	hash, err := argon2hash.GenerateFromPassword(password, argon2hash.DefaultParams())
+	hash, err := argon2hash.GenerateFromPassword(password, params)
 
 	if err != nil {
 		return "", fmt.Errorf("failed to generate hash from password: %w", err)
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/auth/argon2hash"
+)
+
+type passwords map[string]string
+
+func (p passwords) GetPasswordHash(ctx context.Context, userName string) (string, string, error) {
+	hash, ok := p[userName]
+	if !ok {
+		return "", "", nil
+	}
+
+	return userName, hash, nil
+}
+
+func (p passwords) UpdatePasswordHash(ctx context.Context, userID, hash string) error {
+	p[userID] = hash
+
+	return nil
+}
+
+func TestLoginRehash(t *testing.T) {
+	ctx := context.Background()
+	weak := argon2hash.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	policy := argon2hash.Params{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	hash, err := argon2hash.GenerateFromPassword("111", weak)
+	require.NoError(t, err)
+
+	p := passwords{"user1": hash}
+
+	// a wrong password does not upgrade the hash
+	_, err = Login(ctx, "user1", "112", policy, p)
+	assert.ErrorIs(t, err, ErrUnathorized)
+	assert.Equal(t, hash, p["user1"])
+
+	userID, err := Login(ctx, "user1", "111", policy, p)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+
+	upgraded := p["user1"]
+	assert.NotEqual(t, hash, upgraded)
+
+	weakHash, err := argon2hash.NeedsRehash(upgraded, policy)
+	require.NoError(t, err)
+	assert.False(t, weakHash)
+
+	// the upgraded hash still matches and is not replaced again
+	_, err = Login(ctx, "user1", "111", policy, p)
+	require.NoError(t, err)
+	assert.Equal(t, upgraded, p["user1"])
+
+	_, err = Login(ctx, "user2", "111", policy, p)
+	assert.ErrorIs(t, err, ErrUnathorized)
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type (
+	// Attempts are recent failed logins by the same username or from the same IP address
+	Attempts struct {
+		Failures    int
+		LastFailure time.Time
+	}
+
+	// Policy tells how long to wait after failed logins. The first FreeAttempts failures
+	// are not delayed, then the delay doubles from BaseDelay with every failure
+	// up to the Lockout after MaxFailures. Failures older than the Lockout are forgotten.
+	Policy struct {
+		FreeAttempts int
+		MaxFailures  int
+		BaseDelay    time.Duration
+		Lockout      time.Duration
+	}
+
+	attemptsStorage interface {
+		LoginAttempts(ctx context.Context, keys []string, since time.Time) (map[string]Attempts, error)
+		RecordLoginFailure(ctx context.Context, key string, since time.Time) error
+		ResetLoginFailures(ctx context.Context, key string) error
+	}
+
+	// Limiter slows down password guessing by username and by client IP address.
+	// Counters are kept in the storage so they are shared by replicas.
+	Limiter struct {
+		strg attemptsStorage
+		user Policy
+		ip   Policy
+	}
+)
+
+// Delay returns how long logins are blocked for after the last failure
+func (p Policy) Delay(failures int) time.Duration {
+	switch {
+	case failures < p.FreeAttempts || failures == 0:
+		return 0
+	case p.MaxFailures > 0 && failures >= p.MaxFailures:
+		return p.Lockout
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failures && delay < p.Lockout; i++ {
+		delay *= 2
+	}
+
+	if delay > p.Lockout {
+		return p.Lockout
+	}
+
+	return delay
+}
+
+func NewLimiter(strg attemptsStorage, user, ip Policy) *Limiter {
+	return &Limiter{strg: strg, user: user, ip: ip}
+}
+
+func userKey(userName string) string {
+	return "user:" + userName
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Allow returns the time to wait before the next login attempt or 0 if it is allowed now
+func (l *Limiter) Allow(ctx context.Context, userName, ip string) (time.Duration, error) {
+	now := time.Now()
+
+	attempts, err := l.strg.LoginAttempts(ctx, []string{userKey(userName), ipKey(ip)}, l.since(now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to check login attempts: %w", err)
+	}
+
+	var wait time.Duration
+
+	for _, v := range []struct {
+		key    string
+		policy Policy
+	}{{userKey(userName), l.user}, {ipKey(ip), l.ip}} {
+		a, ok := attempts[v.key]
+		if !ok {
+			continue
+		}
+
+		if w := a.LastFailure.Add(v.policy.Delay(a.Failures)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+
+	return wait, nil
+}
+
+// Failed counts the failed login by the username and the IP address
+func (l *Limiter) Failed(ctx context.Context, userName, ip string) error {
+	since := l.since(time.Now())
+
+	for _, key := range []string{userKey(userName), ipKey(ip)} {
+		if err := l.strg.RecordLoginFailure(ctx, key, since); err != nil {
+			return fmt.Errorf("failed to record login failure: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Succeeded resets failures of the username, failures from the IP address are kept
+// as it might be guessing passwords of other users
+func (l *Limiter) Succeeded(ctx context.Context, userName string) error {
+	if err := l.strg.ResetLoginFailures(ctx, userKey(userName)); err != nil {
+		return fmt.Errorf("failed to reset login failures: %w", err)
+	}
+
+	return nil
+}
+
+// since returns the time failures before which are forgotten
+func (l *Limiter) since(now time.Time) time.Time {
+	window := l.user.Lockout
+	if l.ip.Lockout > window {
+		window = l.ip.Lockout
+	}
+
+	return now.Add(-window)
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type attemptsMap map[string]Attempts
+
+func (m attemptsMap) LoginAttempts(ctx context.Context, keys []string, since time.Time) (map[string]Attempts, error) {
+	res := make(map[string]Attempts)
+
+	for _, key := range keys {
+		if a, ok := m[key]; ok && !a.LastFailure.Before(since) {
+			res[key] = a
+		}
+	}
+
+	return res, nil
+}
+
+func (m attemptsMap) RecordLoginFailure(ctx context.Context, key string, since time.Time) error {
+	a := m[key]
+	if a.LastFailure.Before(since) {
+		a.Failures = 0
+	}
+
+	a.Failures++
+	a.LastFailure = time.Now()
+	m[key] = a
+
+	return nil
+}
+
+func (m attemptsMap) ResetLoginFailures(ctx context.Context, key string) error {
+	delete(m, key)
+
+	return nil
+}
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{FreeAttempts: 3, MaxFailures: 10, BaseDelay: time.Second, Lockout: 15 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Second},
+		{failures: 4, want: 2 * time.Second},
+		{failures: 6, want: 8 * time.Second},
+		{failures: 9, want: 64 * time.Second},
+		{failures: 10, want: 15 * time.Minute},
+		{failures: 1000, want: 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, p.Delay(tt.failures), "%v failures", tt.failures)
+	}
+
+	// the delay never exceeds the lockout
+	assert.Equal(t, time.Minute, Policy{BaseDelay: time.Second, Lockout: time.Minute}.Delay(20))
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	strg := attemptsMap{}
+	policy := Policy{FreeAttempts: 2, MaxFailures: 3, BaseDelay: time.Minute, Lockout: time.Hour}
+	l := NewLimiter(strg, policy, Policy{FreeAttempts: 3, MaxFailures: 5, BaseDelay: time.Minute, Lockout: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		wait, err := l.Allow(ctx, "user1", "10.0.0.1")
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+
+		require.NoError(t, l.Failed(ctx, "user1", "10.0.0.1"))
+	}
+
+	wait, err := l.Allow(ctx, "user1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, wait, float64(time.Second), "user is not delayed")
+
+	// guessing passwords of other users from the same IP address
+	require.NoError(t, l.Failed(ctx, "user2", "10.0.0.1"))
+
+	wait, err = l.Allow(ctx, "user3", "10.0.0.1")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, wait, float64(time.Second), "IP address is not delayed")
+
+	require.NoError(t, l.Succeeded(ctx, "user1"))
+
+	wait, err = l.Allow(ctx, "user1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait, "user failures are not reset")
+
+	assert.Equal(t, 3, strg["ip:10.0.0.1"].Failures, "IP address failures are reset")
+
+	// failures older than the lockout are forgotten
+	strg["user:user4"] = Attempts{Failures: 10, LastFailure: time.Now().Add(-2 * time.Hour)}
+
+	wait, err = l.Allow(ctx, "user4", "10.0.0.3")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	require.NoError(t, l.Failed(ctx, "user4", "10.0.0.3"))
+	assert.Equal(t, 1, strg["user:user4"].Failures)
+}
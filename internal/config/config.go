@@ -2,7 +2,10 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -11,6 +14,39 @@ type Config struct {
 	accSystem       string
 	dbDSN           string
 	sessionLifeTime time.Duration
+	accWorkers      int
+	accBatchSize    int
+	accTimeout      time.Duration
+	accLease        time.Duration
+	accInterval     time.Duration
+	accMaxBackoff   time.Duration
+	accMaxAge       time.Duration
+	adminToken      string
+	webhookSecret   string
+	pushWindow      time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+	leaderHeartbeat time.Duration
+	idempotencyTTL  time.Duration
+	eventTTL        time.Duration
+	orderMaxLength  int
+	orderPrefixes   string
+	jwtSecret       string
+	jwtKeys         string
+	jwtActiveKey    string
+	refreshLifeTime time.Duration
+	revocationTick  time.Duration
+	loginFree       int
+	loginMax        int
+	loginIPMax      int
+	loginDelay      time.Duration
+	loginLockout    time.Duration
+	argonMemory     int
+	argonIterations int
+	argonThreads    int
+
+	// invalid keeps values that failed to parse to report them from Validate
+	invalid []error
 }
 type (
 	configOption func(o *configOptions)
@@ -44,9 +80,39 @@ func New(opts ...configOption) *Config {
 	configOptions := &configOptions{
 		osArgs: os.Args[1:],
 		envVars: map[string]string{
-			"RUN_ADDRESS":            os.Getenv("RUN_ADDRESS"),
-			"ACCRUAL_SYSTEM_ADDRESS": os.Getenv("ACCRUAL_SYSTEM_ADDRESS"),
-			"DATABASE_URI":           os.Getenv("DATABASE_URI"),
+			"RUN_ADDRESS":               os.Getenv("RUN_ADDRESS"),
+			"ACCRUAL_SYSTEM_ADDRESS":    os.Getenv("ACCRUAL_SYSTEM_ADDRESS"),
+			"DATABASE_URI":              os.Getenv("DATABASE_URI"),
+			"ACCRUAL_WORKERS":           os.Getenv("ACCRUAL_WORKERS"),
+			"ACCRUAL_BATCH_SIZE":        os.Getenv("ACCRUAL_BATCH_SIZE"),
+			"ACCRUAL_TIMEOUT":           os.Getenv("ACCRUAL_TIMEOUT"),
+			"ACCRUAL_LEASE":             os.Getenv("ACCRUAL_LEASE"),
+			"ACCRUAL_POLL_INTERVAL":     os.Getenv("ACCRUAL_POLL_INTERVAL"),
+			"ACCRUAL_MAX_BACKOFF":       os.Getenv("ACCRUAL_MAX_BACKOFF"),
+			"ACCRUAL_MAX_AGE":           os.Getenv("ACCRUAL_MAX_AGE"),
+			"ADMIN_TOKEN":               os.Getenv("ADMIN_TOKEN"),
+			"ACCRUAL_WEBHOOK_SECRET":    os.Getenv("ACCRUAL_WEBHOOK_SECRET"),
+			"ACCRUAL_PUSH_WINDOW":       os.Getenv("ACCRUAL_PUSH_WINDOW"),
+			"ACCRUAL_BREAKER_THRESHOLD": os.Getenv("ACCRUAL_BREAKER_THRESHOLD"),
+			"ACCRUAL_BREAKER_COOLDOWN":  os.Getenv("ACCRUAL_BREAKER_COOLDOWN"),
+			"LEADER_HEARTBEAT":          os.Getenv("LEADER_HEARTBEAT"),
+			"IDEMPOTENCY_TTL":           os.Getenv("IDEMPOTENCY_TTL"),
+			"ACCRUAL_EVENT_TTL":         os.Getenv("ACCRUAL_EVENT_TTL"),
+			"ORDER_NUMBER_MAX_LENGTH":   os.Getenv("ORDER_NUMBER_MAX_LENGTH"),
+			"ORDER_NUMBER_PREFIXES":     os.Getenv("ORDER_NUMBER_PREFIXES"),
+			"JWT_SECRET":                os.Getenv("JWT_SECRET"),
+			"JWT_KEYS":                  os.Getenv("JWT_KEYS"),
+			"JWT_ACTIVE_KEY":            os.Getenv("JWT_ACTIVE_KEY"),
+			"REFRESH_TOKEN_LIFETIME":    os.Getenv("REFRESH_TOKEN_LIFETIME"),
+			"REVOCATION_REFRESH":        os.Getenv("REVOCATION_REFRESH"),
+			"LOGIN_FREE_ATTEMPTS":       os.Getenv("LOGIN_FREE_ATTEMPTS"),
+			"LOGIN_MAX_FAILURES":        os.Getenv("LOGIN_MAX_FAILURES"),
+			"LOGIN_IP_MAX_FAILURES":     os.Getenv("LOGIN_IP_MAX_FAILURES"),
+			"LOGIN_BASE_DELAY":          os.Getenv("LOGIN_BASE_DELAY"),
+			"LOGIN_LOCKOUT":             os.Getenv("LOGIN_LOCKOUT"),
+			"ARGON2_MEMORY":             os.Getenv("ARGON2_MEMORY"),
+			"ARGON2_ITERATIONS":         os.Getenv("ARGON2_ITERATIONS"),
+			"ARGON2_PARALLELISM":        os.Getenv("ARGON2_PARALLELISM"),
 		},
 	}
 
@@ -56,7 +122,35 @@ func New(opts ...configOption) *Config {
 
 	// default:
 	// s := config{"http://localhost:8080", "localhost:8080", oOs.Getenv("HME") + "/storage.csv", "user=postgres password=postgres host=localhost port=5432 dbname=testdb"}
-	s := Config{runAddr: "localhost:8080", accSystem: "http://localhost:8085", sessionLifeTime: 10 * time.Minute}
+	s := Config{
+		runAddr:         "localhost:8080",
+		accSystem:       "http://localhost:8085",
+		sessionLifeTime: 10 * time.Minute,
+		accWorkers:      4,
+		accBatchSize:    100,
+		accTimeout:      5 * time.Second,
+		accLease:        time.Minute,
+		accInterval:     10 * time.Second,
+		accMaxBackoff:   time.Hour,
+		accMaxAge:       7 * 24 * time.Hour,
+		pushWindow:      5 * time.Minute,
+		breakerFailures: 5,
+		breakerCooldown: 30 * time.Second,
+		leaderHeartbeat: 5 * time.Second,
+		idempotencyTTL:  24 * time.Hour,
+		eventTTL:        7 * 24 * time.Hour,
+		orderMaxLength:  100,
+		refreshLifeTime: 30 * 24 * time.Hour,
+		revocationTick:  10 * time.Second,
+		loginFree:       3,
+		loginMax:        10,
+		loginIPMax:      100,
+		loginDelay:      time.Second,
+		loginLockout:    15 * time.Minute,
+		argonMemory:     64 * 1024,
+		argonIterations: 1,
+		argonThreads:    2,
+	}
 
 	if v := configOptions.envVars["RUN_ADDRESS"]; v != "" {
 		s.runAddr = v
@@ -67,6 +161,48 @@ func New(opts ...configOption) *Config {
 	if v := configOptions.envVars["DATABASE_URI"]; v != "" {
 		s.dbDSN = v
 	}
+	s.envInt(configOptions.envVars, "ACCRUAL_WORKERS", &s.accWorkers)
+	s.envInt(configOptions.envVars, "ACCRUAL_BATCH_SIZE", &s.accBatchSize)
+	s.envDuration(configOptions.envVars, "ACCRUAL_TIMEOUT", &s.accTimeout)
+	s.envDuration(configOptions.envVars, "ACCRUAL_LEASE", &s.accLease)
+	s.envDuration(configOptions.envVars, "ACCRUAL_POLL_INTERVAL", &s.accInterval)
+	s.envDuration(configOptions.envVars, "ACCRUAL_MAX_BACKOFF", &s.accMaxBackoff)
+	s.envDuration(configOptions.envVars, "ACCRUAL_MAX_AGE", &s.accMaxAge)
+	if v := configOptions.envVars["ADMIN_TOKEN"]; v != "" {
+		s.adminToken = v
+	}
+	if v := configOptions.envVars["ACCRUAL_WEBHOOK_SECRET"]; v != "" {
+		s.webhookSecret = v
+	}
+	s.envDuration(configOptions.envVars, "ACCRUAL_PUSH_WINDOW", &s.pushWindow)
+	s.envInt(configOptions.envVars, "ACCRUAL_BREAKER_THRESHOLD", &s.breakerFailures)
+	s.envDuration(configOptions.envVars, "ACCRUAL_BREAKER_COOLDOWN", &s.breakerCooldown)
+	s.envDuration(configOptions.envVars, "LEADER_HEARTBEAT", &s.leaderHeartbeat)
+	s.envDuration(configOptions.envVars, "IDEMPOTENCY_TTL", &s.idempotencyTTL)
+	s.envDuration(configOptions.envVars, "ACCRUAL_EVENT_TTL", &s.eventTTL)
+	s.envInt(configOptions.envVars, "ORDER_NUMBER_MAX_LENGTH", &s.orderMaxLength)
+	if v := configOptions.envVars["ORDER_NUMBER_PREFIXES"]; v != "" {
+		s.orderPrefixes = v
+	}
+	if v := configOptions.envVars["JWT_SECRET"]; v != "" {
+		s.jwtSecret = v
+	}
+	if v := configOptions.envVars["JWT_KEYS"]; v != "" {
+		s.jwtKeys = v
+	}
+	if v := configOptions.envVars["JWT_ACTIVE_KEY"]; v != "" {
+		s.jwtActiveKey = v
+	}
+	s.envDuration(configOptions.envVars, "REFRESH_TOKEN_LIFETIME", &s.refreshLifeTime)
+	s.envDuration(configOptions.envVars, "REVOCATION_REFRESH", &s.revocationTick)
+	s.envInt(configOptions.envVars, "LOGIN_FREE_ATTEMPTS", &s.loginFree)
+	s.envInt(configOptions.envVars, "LOGIN_MAX_FAILURES", &s.loginMax)
+	s.envInt(configOptions.envVars, "LOGIN_IP_MAX_FAILURES", &s.loginIPMax)
+	s.envDuration(configOptions.envVars, "LOGIN_BASE_DELAY", &s.loginDelay)
+	s.envDuration(configOptions.envVars, "LOGIN_LOCKOUT", &s.loginLockout)
+	s.envInt(configOptions.envVars, "ARGON2_MEMORY", &s.argonMemory)
+	s.envInt(configOptions.envVars, "ARGON2_ITERATIONS", &s.argonIterations)
+	s.envInt(configOptions.envVars, "ARGON2_PARALLELISM", &s.argonThreads)
 
 	if !configOptions.ignoreOsArgs {
 		fs := flag.NewFlagSet("myFS", flag.ContinueOnError)
@@ -74,6 +210,36 @@ func New(opts ...configOption) *Config {
 			fs.StringVar(&s.runAddr, "a", s.runAddr, "service address")
 			fs.StringVar(&s.accSystem, "r", s.accSystem, "accrual system address")
 			fs.StringVar(&s.dbDSN, "d", s.dbDSN, "database dsn")
+			fs.IntVar(&s.accWorkers, "accrual-workers", s.accWorkers, "number of concurrent requests to accrual system")
+			fs.IntVar(&s.accBatchSize, "accrual-batch", s.accBatchSize, "number of order statuses stored at once")
+			fs.DurationVar(&s.accTimeout, "accrual-timeout", s.accTimeout, "accrual system request timeout")
+			fs.DurationVar(&s.accLease, "accrual-lease", s.accLease, "time an order is leased for polling")
+			fs.DurationVar(&s.accInterval, "accrual-interval", s.accInterval, "accrual system polling interval")
+			fs.DurationVar(&s.accMaxBackoff, "accrual-max-backoff", s.accMaxBackoff, "max delay between polls of an order")
+			fs.DurationVar(&s.accMaxAge, "accrual-max-age", s.accMaxAge, "time after which an order is considered stale")
+			fs.StringVar(&s.adminToken, "admin-token", s.adminToken, "bearer token to access admin API")
+			fs.StringVar(&s.webhookSecret, "accrual-webhook-secret", s.webhookSecret, "secret to verify accrual events signatures")
+			fs.DurationVar(&s.pushWindow, "accrual-push-window", s.pushWindow, "time to wait for accrual event before polling an order")
+			fs.IntVar(&s.breakerFailures, "accrual-breaker-threshold", s.breakerFailures, "consecutive accrual system failures to suspend requests, 0 to disable")
+			fs.DurationVar(&s.breakerCooldown, "accrual-breaker-cooldown", s.breakerCooldown, "time accrual system requests are suspended for")
+			fs.DurationVar(&s.leaderHeartbeat, "leader-heartbeat", s.leaderHeartbeat, "leader election check interval")
+			fs.DurationVar(&s.idempotencyTTL, "idempotency-ttl", s.idempotencyTTL, "how long responses to requests with Idempotency-Key are replayed")
+			fs.DurationVar(&s.eventTTL, "accrual-event-ttl", s.eventTTL, "how long IDs of accrual events are kept to skip redelivered ones")
+			fs.IntVar(&s.orderMaxLength, "order-max-length", s.orderMaxLength, "max number of digits in order numbers, 0 for no limit")
+			fs.StringVar(&s.orderPrefixes, "order-prefixes", s.orderPrefixes, "comma separated order number prefixes or prefix ranges, e.g. 4,51-55")
+			fs.StringVar(&s.jwtSecret, "jwt-secret", s.jwtSecret, "HMAC secret to sign session tokens")
+			fs.StringVar(&s.jwtKeys, "jwt-keys", s.jwtKeys, "comma separated id=path files of keys to sign session tokens")
+			fs.StringVar(&s.jwtActiveKey, "jwt-active-key", s.jwtActiveKey, "ID of the key signing new session tokens")
+			fs.DurationVar(&s.refreshLifeTime, "refresh-lifetime", s.refreshLifeTime, "time a session can be refreshed for before logging in again")
+			fs.DurationVar(&s.revocationTick, "revocation-refresh", s.revocationTick, "interval of loading sessions revoked by other replicas")
+			fs.IntVar(&s.loginFree, "login-free-attempts", s.loginFree, "failed logins of a user before delaying the next ones")
+			fs.IntVar(&s.loginMax, "login-max-failures", s.loginMax, "failed logins of a user before the lockout")
+			fs.IntVar(&s.loginIPMax, "login-ip-max-failures", s.loginIPMax, "failed logins from an IP address before the lockout")
+			fs.DurationVar(&s.loginDelay, "login-base-delay", s.loginDelay, "delay after the first delayed failed login, doubled with every next one")
+			fs.DurationVar(&s.loginLockout, "login-lockout", s.loginLockout, "time logins are locked out for, failed logins are forgotten after it")
+			fs.IntVar(&s.argonMemory, "argon2-memory", s.argonMemory, "memory in KiB to hash a password with argon2id")
+			fs.IntVar(&s.argonIterations, "argon2-iterations", s.argonIterations, "number of argon2id iterations to hash a password")
+			fs.IntVar(&s.argonThreads, "argon2-parallelism", s.argonThreads, "number of argon2id threads to hash a password")
 
 			fs.Parse(configOptions.osArgs)
 		}
@@ -97,3 +263,228 @@ func (c Config) DatabaseDSN() string {
 func (c Config) RunAddress() string {
 	return c.runAddr
 }
+
+func (c Config) AccrualWorkers() int {
+	return c.accWorkers
+}
+
+func (c Config) AccrualBatchSize() int {
+	return c.accBatchSize
+}
+
+func (c Config) AccrualTimeout() time.Duration {
+	return c.accTimeout
+}
+
+func (c Config) AccrualLease() time.Duration {
+	return c.accLease
+}
+
+func (c Config) AccrualPollInterval() time.Duration {
+	return c.accInterval
+}
+
+func (c Config) AccrualMaxBackoff() time.Duration {
+	return c.accMaxBackoff
+}
+
+func (c Config) AccrualMaxAge() time.Duration {
+	return c.accMaxAge
+}
+
+func (c Config) AdminToken() string {
+	return c.adminToken
+}
+
+func (c Config) AccrualWebhookSecret() string {
+	return c.webhookSecret
+}
+
+func (c Config) AccrualPushWindow() time.Duration {
+	return c.pushWindow
+}
+
+func (c Config) AccrualBreakerThreshold() int {
+	return c.breakerFailures
+}
+
+func (c Config) AccrualBreakerCooldown() time.Duration {
+	return c.breakerCooldown
+}
+
+func (c Config) LeaderHeartbeat() time.Duration {
+	return c.leaderHeartbeat
+}
+
+func (c Config) IdempotencyTTL() time.Duration {
+	return c.idempotencyTTL
+}
+
+func (c Config) AccrualEventTTL() time.Duration {
+	return c.eventTTL
+}
+
+func (c Config) OrderNumberMaxLength() int {
+	return c.orderMaxLength
+}
+
+func (c Config) OrderNumberPrefixes() string {
+	return c.orderPrefixes
+}
+
+func (c Config) JWTSecret() string {
+	return c.jwtSecret
+}
+
+func (c Config) JWTKeys() string {
+	return c.jwtKeys
+}
+
+func (c Config) JWTActiveKey() string {
+	return c.jwtActiveKey
+}
+
+func (c Config) RefreshTokenLifetime() time.Duration {
+	return c.refreshLifeTime
+}
+
+func (c Config) RevocationRefreshInterval() time.Duration {
+	return c.revocationTick
+}
+
+func (c Config) LoginFreeAttempts() int {
+	return c.loginFree
+}
+
+func (c Config) LoginMaxFailures() int {
+	return c.loginMax
+}
+
+func (c Config) LoginIPMaxFailures() int {
+	return c.loginIPMax
+}
+
+func (c Config) LoginBaseDelay() time.Duration {
+	return c.loginDelay
+}
+
+func (c Config) LoginLockout() time.Duration {
+	return c.loginLockout
+}
+
+func (c Config) Argon2Memory() uint32 {
+	return uint32(c.argonMemory)
+}
+
+func (c Config) Argon2Iterations() uint32 {
+	return uint32(c.argonIterations)
+}
+
+func (c Config) Argon2Parallelism() uint8 {
+	return uint8(c.argonThreads)
+}
+
+// envInt parses the number set by the environment variable name into n,
+// a value that fails to parse is reported by Validate
+func (c *Config) envInt(envVars map[string]string, name string, n *int) {
+	v := envVars[name]
+	if v == "" {
+		return
+	}
+
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		c.invalid = append(c.invalid, fmt.Errorf("invalid %v value %q: %w", name, v, err))
+
+		return
+	}
+
+	*n = parsed
+}
+
+// envDuration parses the duration set by the environment variable name into d,
+// a value that fails to parse is reported by Validate
+func (c *Config) envDuration(envVars map[string]string, name string, d *time.Duration) {
+	v := envVars[name]
+	if v == "" {
+		return
+	}
+
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		c.invalid = append(c.invalid, fmt.Errorf("invalid %v value %q: %w", name, v, err))
+
+		return
+	}
+
+	*d = parsed
+}
+
+// Validate reports settings the service can not run with
+func (c Config) Validate() error {
+	if len(c.invalid) > 0 {
+		return c.invalid[0]
+	}
+
+	if c.accTimeout <= 0 {
+		return fmt.Errorf("accrual timeout must be positive, got %v", c.accTimeout)
+	}
+
+	// an order leased for no time could be leased by several replicas at once
+	if c.accLease <= 0 {
+		return fmt.Errorf("accrual lease must be positive, got %v", c.accLease)
+	}
+
+	if c.accInterval <= 0 {
+		return fmt.Errorf("accrual poll interval must be positive, got %v", c.accInterval)
+	}
+
+	if c.leaderHeartbeat <= 0 {
+		return fmt.Errorf("leader heartbeat must be positive, got %v", c.leaderHeartbeat)
+	}
+
+	if c.revocationTick <= 0 {
+		return fmt.Errorf("revocation refresh interval must be positive, got %v", c.revocationTick)
+	}
+
+	// events would be forgotten as soon as they are applied and redeliveries applied again
+	if c.eventTTL <= 0 {
+		return fmt.Errorf("accrual event TTL must be positive, got %v", c.eventTTL)
+	}
+
+	if c.loginFree < 0 {
+		return fmt.Errorf("free login attempts must not be negative, got %v", c.loginFree)
+	}
+
+	if c.loginMax < c.loginFree {
+		return fmt.Errorf("login max failures (%v) must not be less than free attempts (%v)", c.loginMax, c.loginFree)
+	}
+
+	// the IP address lockout starts after the user one
+	if c.loginIPMax < c.loginMax {
+		return fmt.Errorf("login IP max failures (%v) must not be less than user max failures (%v)", c.loginIPMax, c.loginMax)
+	}
+
+	if c.loginDelay <= 0 {
+		return fmt.Errorf("login base delay must be positive, got %v", c.loginDelay)
+	}
+
+	// with a shorter lockout failures are forgotten before they are delayed
+	if c.loginLockout < c.loginDelay {
+		return fmt.Errorf("login lockout (%v) must not be shorter than the base delay (%v)", c.loginLockout, c.loginDelay)
+	}
+
+	if c.argonMemory < 1 || uint64(c.argonMemory) > math.MaxUint32 {
+		return fmt.Errorf("argon2 memory must be between 1 and %v KiB, got %v", uint32(math.MaxUint32), c.argonMemory)
+	}
+
+	if c.argonIterations < 1 || uint64(c.argonIterations) > math.MaxUint32 {
+		return fmt.Errorf("argon2 iterations must be between 1 and %v, got %v", uint32(math.MaxUint32), c.argonIterations)
+	}
+
+	if c.argonThreads < 1 || c.argonThreads > math.MaxUint8 {
+		return fmt.Errorf("argon2 parallelism must be between 1 and %v, got %v", math.MaxUint8, c.argonThreads)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{},
+		},
+		{
+			name: "accrual poll interval",
+			env:  map[string]string{"ACCRUAL_POLL_INTERVAL": "1m"},
+		},
+		{
+			name: "argon2 parameters",
+			env:  map[string]string{"ARGON2_MEMORY": "1024", "ARGON2_ITERATIONS": "3", "ARGON2_PARALLELISM": "255"},
+		},
+		{
+			name:    "zero accrual lease",
+			env:     map[string]string{"ACCRUAL_LEASE": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "negative accrual timeout",
+			env:     map[string]string{"ACCRUAL_TIMEOUT": "-5s"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid accrual lease",
+			env:     map[string]string{"ACCRUAL_LEASE": "minute"},
+			wantErr: true,
+		},
+		{
+			name:    "zero accrual poll interval",
+			env:     map[string]string{"ACCRUAL_POLL_INTERVAL": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "negative accrual poll interval",
+			env:     map[string]string{"ACCRUAL_POLL_INTERVAL": "-1s"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid accrual poll interval",
+			env:     map[string]string{"ACCRUAL_POLL_INTERVAL": "10"},
+			wantErr: true,
+		},
+		{
+			name:    "zero leader heartbeat",
+			env:     map[string]string{"LEADER_HEARTBEAT": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid leader heartbeat",
+			env:     map[string]string{"LEADER_HEARTBEAT": "often"},
+			wantErr: true,
+		},
+		{
+			name:    "negative revocation refresh",
+			env:     map[string]string{"REVOCATION_REFRESH": "-10s"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid revocation refresh",
+			env:     map[string]string{"REVOCATION_REFRESH": "10"},
+			wantErr: true,
+		},
+		{
+			name:    "zero accrual event TTL",
+			env:     map[string]string{"ACCRUAL_EVENT_TTL": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid number",
+			env:     map[string]string{"ACCRUAL_WORKERS": "four"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			env:     map[string]string{"IDEMPOTENCY_TTL": "1 day"},
+			wantErr: true,
+		},
+		{
+			name: "login limits",
+			env:  map[string]string{"LOGIN_FREE_ATTEMPTS": "5", "LOGIN_MAX_FAILURES": "5", "LOGIN_IP_MAX_FAILURES": "50", "LOGIN_LOCKOUT": "1s"},
+		},
+		{
+			name:    "invalid login max failures",
+			env:     map[string]string{"LOGIN_MAX_FAILURES": "ten"},
+			wantErr: true,
+		},
+		{
+			name:    "max failures below free attempts",
+			env:     map[string]string{"LOGIN_FREE_ATTEMPTS": "5", "LOGIN_MAX_FAILURES": "4"},
+			wantErr: true,
+		},
+		{
+			name:    "IP max failures below user max failures",
+			env:     map[string]string{"LOGIN_IP_MAX_FAILURES": "5"},
+			wantErr: true,
+		},
+		{
+			name:    "zero login base delay",
+			env:     map[string]string{"LOGIN_BASE_DELAY": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "zero login lockout",
+			env:     map[string]string{"LOGIN_LOCKOUT": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "zero argon2 memory",
+			env:     map[string]string{"ARGON2_MEMORY": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "zero argon2 iterations",
+			env:     map[string]string{"ARGON2_ITERATIONS": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "zero argon2 parallelism",
+			env:     map[string]string{"ARGON2_PARALLELISM": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "argon2 parallelism overflow",
+			env:     map[string]string{"ARGON2_PARALLELISM": "256"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := New(WithEnvVars(tt.env), IgnoreOsArgs()).Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Package idempotency describes responses saved for requests sent with an Idempotency-Key header
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Header is the request header holding the key chosen by the client
+const Header = "Idempotency-Key"
+
+// Record is the request stored under a key. Until the request is completed
+// the record only holds the fingerprint of the request.
+type Record struct {
+	Fingerprint string
+	Completed   bool
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Fingerprint identifies the request payload so a key can't be reused for a different request
+func Fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,192 @@
+// Package leader elects a single replica to run singleton background jobs
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+
+	// DefaultKey is the advisory lock key held by the leader
+	DefaultKey int64 = 0x676f7068
+)
+
+type (
+	// Elector holds a Postgres advisory lock on a dedicated connection while it is the leader.
+	// The connection is checked every heartbeat, once it's lost the lock is released by Postgres
+	// and one of the followers takes over.
+	Elector struct {
+		db        *sql.DB
+		key       int64
+		heartbeat time.Duration
+
+		mu     sync.Mutex
+		conn   *sql.Conn
+		leader bool
+		since  time.Time
+	}
+
+	// State describes the replica role for operators
+	State struct {
+		Role  string    `json:"role"`
+		Since time.Time `json:"since"`
+	}
+
+	// Standalone is the leader of a single replica deployment
+	Standalone struct {
+		since time.Time
+	}
+)
+
+// New returns a follower Elector competing for the lock with the given key
+func New(db *sql.DB, key int64, heartbeat time.Duration) *Elector {
+	return &Elector{db: db, key: key, heartbeat: heartbeat, since: time.Now()}
+}
+
+// Run campaigns for leadership and keeps it until ctx is done
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		if e.IsLeader() {
+			if err := e.check(ctx); err != nil {
+				log.Printf("lost leadership: %v\n", err)
+				e.resign()
+			}
+		} else if err := e.campaign(ctx); err != nil {
+			log.Printf("failed to campaign for leadership: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			e.release()
+
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsLeader returns true if the replica holds the lock
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// State returns current role of the replica
+func (e *Elector) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leader {
+		return State{Role: RoleLeader, Since: e.since}
+	}
+
+	return State{Role: RoleFollower, Since: e.since}
+}
+
+// campaign tries to take the lock on a new connection
+func (e *Elector) campaign(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.heartbeat)
+	defer cancel()
+
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+
+	var locked bool
+
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.conn = conn
+	e.leader = true
+	e.since = time.Now()
+
+	log.Printf("became the leader\n")
+
+	return nil
+}
+
+// check makes sure the session holding the lock is alive,
+// session level advisory lock is released only when the session ends
+func (e *Elector) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.heartbeat)
+	defer cancel()
+
+	e.mu.Lock()
+	conn := e.conn
+	e.mu.Unlock()
+
+	var one int
+
+	return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// resign closes the connection holding the lock so Postgres releases it.
+// The connection is discarded rather than returned to the pool.
+func (e *Elector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil {
+		e.conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+		e.conn.Close()
+		e.conn = nil
+	}
+
+	e.leader = false
+	e.since = time.Now()
+}
+
+// release unlocks the lock explicitly to let a follower take over right away
+func (e *Elector) release() {
+	e.mu.Lock()
+	conn := e.conn
+	e.mu.Unlock()
+
+	if conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), e.heartbeat)
+		defer cancel()
+
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", e.key); err != nil {
+			log.Printf("failed to release leadership: %v\n", err)
+		}
+	}
+
+	e.resign()
+}
+
+// NewStandalone returns an elector that is always the leader
+func NewStandalone() Standalone {
+	return Standalone{since: time.Now()}
+}
+
+func (s Standalone) IsLeader() bool {
+	return true
+}
+
+func (s Standalone) State() State {
+	return State{Role: RoleLeader, Since: s.since}
+}
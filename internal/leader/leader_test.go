@@ -0,0 +1,120 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/stdlib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHeartbeat = 50 * time.Millisecond
+
+// newTestDB connects to the database given by GOPHERMART_TEST_DSN or skips the test
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GOPHERMART_TEST_DSN")
+	if dsn == "" {
+		t.Skip("GOPHERMART_TEST_DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// run starts the elector and returns a function stopping it and waiting for it to step down
+func run(e *Elector) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// testKey returns a lock key of its own not to compete with a running service or parallel runs
+func testKey() int64 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
+}
+
+func TestAcquire(t *testing.T) {
+	e := New(newTestDB(t), testKey(), testHeartbeat)
+	assert.Equal(t, RoleFollower, e.State().Role)
+
+	stop := run(e)
+	defer stop()
+
+	require.Eventually(t, e.IsLeader, time.Second, testHeartbeat/5, "the lock is not acquired")
+	assert.Equal(t, RoleLeader, e.State().Role)
+}
+
+func TestFollower(t *testing.T) {
+	db := newTestDB(t)
+	key := testKey()
+
+	leader, follower := New(db, key, testHeartbeat), New(db, key, testHeartbeat)
+
+	stopLeader := run(leader)
+	defer stopLeader()
+
+	require.Eventually(t, leader.IsLeader, time.Second, testHeartbeat/5)
+
+	stopFollower := run(follower)
+	defer stopFollower()
+
+	// the follower keeps campaigning while the lock is held
+	time.Sleep(3 * testHeartbeat)
+	assert.True(t, leader.IsLeader())
+	assert.False(t, follower.IsLeader())
+	assert.Equal(t, RoleFollower, follower.State().Role)
+}
+
+func TestReleaseOnCancel(t *testing.T) {
+	db := newTestDB(t)
+	key := testKey()
+
+	leader, follower := New(db, key, testHeartbeat), New(db, key, testHeartbeat)
+
+	stopLeader := run(leader)
+	require.Eventually(t, leader.IsLeader, time.Second, testHeartbeat/5)
+
+	stopFollower := run(follower)
+	defer stopFollower()
+
+	time.Sleep(2 * testHeartbeat)
+	followerSince := follower.State().Since
+
+	stopLeader()
+
+	assert.False(t, leader.IsLeader(), "leadership is kept after the context is done")
+	assert.Equal(t, RoleFollower, leader.State().Role)
+
+	require.Eventually(t, follower.IsLeader, time.Second, testHeartbeat/5, "the released lock is not taken over")
+
+	state := follower.State()
+	assert.Equal(t, RoleLeader, state.Role)
+	assert.True(t, state.Since.After(followerSince))
+}
+
+func TestStandalone(t *testing.T) {
+	s := NewStandalone()
+
+	assert.True(t, s.IsLeader())
+	assert.Equal(t, RoleLeader, s.State().Role)
+}
@@ -0,0 +1,87 @@
+// Package ledger describes the double-entry ledger loyalty balances are derived from.
+// Every operation posts two entries that sum up to zero: one to the user's account
+// and the opposite one to a system account, so a user's balance is the sum of the
+// entries on their account and the whole ledger always sums up to zero.
+package ledger
+
+import (
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/money"
+)
+
+const (
+	// KindAccrual entries credit points the accrual system granted for an order
+	KindAccrual = "ACCRUAL"
+	// KindWithdrawal entries debit points spent on an order
+	KindWithdrawal = "WITHDRAWAL"
+
+	// AccountAccruals is the system account points are credited from
+	AccountAccruals = "system:accruals"
+	// AccountWithdrawals is the system account points are withdrawn to
+	AccountWithdrawals = "system:withdrawals"
+)
+
+// Entry is a single immutable ledger record. An account has at most one entry
+// of a kind for the same reference, which is the order number.
+type Entry struct {
+	Account   string
+	Amount    money.Amount
+	Kind      string
+	Reference string
+	CreatedAt time.Time
+}
+
+// Accrual returns entries crediting the user with points accrued for the order
+func Accrual(userID, order string, amount money.Amount, at time.Time) []Entry {
+	return []Entry{
+		{Account: userID, Amount: amount, Kind: KindAccrual, Reference: order, CreatedAt: at},
+		{Account: AccountAccruals, Amount: -amount, Kind: KindAccrual, Reference: order, CreatedAt: at},
+	}
+}
+
+// Withdrawal returns entries debiting the user with points spent on the order
+func Withdrawal(userID, order string, amount money.Amount, at time.Time) []Entry {
+	return []Entry{
+		{Account: userID, Amount: -amount, Kind: KindWithdrawal, Reference: order, CreatedAt: at},
+		{Account: AccountWithdrawals, Amount: amount, Kind: KindWithdrawal, Reference: order, CreatedAt: at},
+	}
+}
+
+// Balance returns the current balance and the total withdrawn from the account
+func Balance(entries []Entry, account string) (money.Amount, money.Amount) {
+	var current, withdrawn money.Amount
+
+	for _, e := range entries {
+		if e.Account != account {
+			continue
+		}
+
+		current += e.Amount
+
+		if e.Kind == KindWithdrawal {
+			withdrawn -= e.Amount
+		}
+	}
+
+	return current, withdrawn
+}
+
+// Balanced returns true if entries of every operation sum up to zero
+func Balanced(entries []Entry) bool {
+	type operation struct{ kind, reference string }
+
+	sums := make(map[operation]money.Amount)
+
+	for _, e := range entries {
+		sums[operation{e.Kind, e.Reference}] += e.Amount
+	}
+
+	for _, sum := range sums {
+		if sum != 0 {
+			return false
+		}
+	}
+
+	return true
+}
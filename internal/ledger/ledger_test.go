@@ -0,0 +1,41 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/usa4ev/gophermart/internal/money"
+)
+
+func TestBalance(t *testing.T) {
+	now := time.Now()
+
+	var entries []Entry
+
+	entries = append(entries, Accrual("user1", "12345678903", money.Amount(50050), now)...)
+	entries = append(entries, Accrual("user2", "79927398713", money.Points(100), now)...)
+	entries = append(entries, Withdrawal("user1", "2377225624", money.Amount(20025), now)...)
+
+	current, withdrawn := Balance(entries, "user1")
+	assert.Equal(t, money.Amount(30025), current)
+	assert.Equal(t, money.Amount(20025), withdrawn)
+
+	current, withdrawn = Balance(entries, "user2")
+	assert.Equal(t, money.Points(100), current)
+	assert.Equal(t, money.Amount(0), withdrawn)
+
+	current, _ = Balance(entries, AccountAccruals)
+	assert.Equal(t, -money.Amount(60050), current)
+
+	assert.True(t, Balanced(entries))
+}
+
+func TestBalanced(t *testing.T) {
+	entries := Accrual("user1", "12345678903", money.Points(5), time.Now())
+	entries[0].Amount++
+
+	assert.False(t, Balanced(entries))
+	assert.True(t, Balanced(nil))
+}
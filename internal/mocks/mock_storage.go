@@ -7,9 +7,14 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
+	auth "github.com/usa4ev/gophermart/internal/auth"
+	idempotency "github.com/usa4ev/gophermart/internal/idempotency"
+	money "github.com/usa4ev/gophermart/internal/money"
 	orders "github.com/usa4ev/gophermart/internal/orders"
+	session "github.com/usa4ev/gophermart/internal/session"
 )
 
 // MockStorage is a mock of Storage interface.
@@ -50,6 +55,76 @@ func (mr *MockStorageMockRecorder) AddUser(arg0, arg1, arg2 interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddUser", reflect.TypeOf((*MockStorage)(nil).AddUser), arg0, arg1, arg2)
 }
 
+// CompleteIdempotencyKey mocks base method.
+func (m *MockStorage) CompleteIdempotencyKey(arg0 context.Context, arg1, arg2 string, arg3 idempotency.Record) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteIdempotencyKey", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteIdempotencyKey indicates an expected call of CompleteIdempotencyKey.
+func (mr *MockStorageMockRecorder) CompleteIdempotencyKey(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).CompleteIdempotencyKey), arg0, arg1, arg2, arg3)
+}
+
+// CreateSession mocks base method.
+func (m *MockStorage) CreateSession(arg0 context.Context, arg1, arg2, arg3 string, arg4 session.Device, arg5 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSession", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateSession indicates an expected call of CreateSession.
+func (mr *MockStorageMockRecorder) CreateSession(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSession", reflect.TypeOf((*MockStorage)(nil).CreateSession), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+// ExpireEvents mocks base method.
+func (m *MockStorage) ExpireEvents(arg0 context.Context, arg1 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireEvents", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExpireEvents indicates an expected call of ExpireEvents.
+func (mr *MockStorageMockRecorder) ExpireEvents(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireEvents", reflect.TypeOf((*MockStorage)(nil).ExpireEvents), arg0, arg1)
+}
+
+// ExpireIdempotencyKeys mocks base method.
+func (m *MockStorage) ExpireIdempotencyKeys(arg0 context.Context, arg1 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireIdempotencyKeys", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExpireIdempotencyKeys indicates an expected call of ExpireIdempotencyKeys.
+func (mr *MockStorageMockRecorder) ExpireIdempotencyKeys(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireIdempotencyKeys", reflect.TypeOf((*MockStorage)(nil).ExpireIdempotencyKeys), arg0, arg1)
+}
+
+// ForgetEvent mocks base method.
+func (m *MockStorage) ForgetEvent(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ForgetEvent", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ForgetEvent indicates an expected call of ForgetEvent.
+func (mr *MockStorageMockRecorder) ForgetEvent(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForgetEvent", reflect.TypeOf((*MockStorage)(nil).ForgetEvent), arg0, arg1)
+}
+
 // GetPasswordHash mocks base method.
 func (m *MockStorage) GetPasswordHash(arg0 context.Context, arg1 string) (string, string, error) {
 	m.ctrl.T.Helper()
@@ -67,11 +142,11 @@ func (mr *MockStorageMockRecorder) GetPasswordHash(arg0, arg1 interface{}) *gomo
 }
 
 // LoadBalance mocks base method.
-func (m *MockStorage) LoadBalance(arg0 context.Context, arg1 string) (float64, float64, error) {
+func (m *MockStorage) LoadBalance(arg0 context.Context, arg1 string) (money.Amount, money.Amount, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "LoadBalance", arg0, arg1)
-	ret0, _ := ret[0].(float64)
-	ret1, _ := ret[1].(float64)
+	ret0, _ := ret[0].(money.Amount)
+	ret1, _ := ret[1].(money.Amount)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
@@ -82,63 +157,326 @@ func (mr *MockStorageMockRecorder) LoadBalance(arg0, arg1 interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadBalance", reflect.TypeOf((*MockStorage)(nil).LoadBalance), arg0, arg1)
 }
 
+// LoadOrder mocks base method.
+func (m *MockStorage) LoadOrder(arg0 context.Context, arg1, arg2 string) (orders.Details, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadOrder", arg0, arg1, arg2)
+	ret0, _ := ret[0].(orders.Details)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadOrder indicates an expected call of LoadOrder.
+func (mr *MockStorageMockRecorder) LoadOrder(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadOrder", reflect.TypeOf((*MockStorage)(nil).LoadOrder), arg0, arg1, arg2)
+}
+
 // LoadOrders mocks base method.
-func (m *MockStorage) LoadOrders(arg0 context.Context, arg1 string) ([]byte, error) {
+func (m *MockStorage) LoadOrders(arg0 context.Context, arg1 string, arg2 orders.Filter) ([]orders.Order, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "LoadOrders", arg0, arg1)
-	ret0, _ := ret[0].([]byte)
+	ret := m.ctrl.Call(m, "LoadOrders", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]orders.Order)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // LoadOrders indicates an expected call of LoadOrders.
-func (mr *MockStorageMockRecorder) LoadOrders(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) LoadOrders(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadOrders", reflect.TypeOf((*MockStorage)(nil).LoadOrders), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadOrders", reflect.TypeOf((*MockStorage)(nil).LoadOrders), arg0, arg1, arg2)
+}
+
+// LoadSessions mocks base method.
+func (m *MockStorage) LoadSessions(arg0 context.Context, arg1 string) ([]session.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadSessions", arg0, arg1)
+	ret0, _ := ret[0].([]session.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadSessions indicates an expected call of LoadSessions.
+func (mr *MockStorageMockRecorder) LoadSessions(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadSessions", reflect.TypeOf((*MockStorage)(nil).LoadSessions), arg0, arg1)
+}
+
+// LoadStaleOrders mocks base method.
+func (m *MockStorage) LoadStaleOrders(arg0 context.Context) ([]orders.StaleOrder, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadStaleOrders", arg0)
+	ret0, _ := ret[0].([]orders.StaleOrder)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadStaleOrders indicates an expected call of LoadStaleOrders.
+func (mr *MockStorageMockRecorder) LoadStaleOrders(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadStaleOrders", reflect.TypeOf((*MockStorage)(nil).LoadStaleOrders), arg0)
 }
 
 // LoadWithdrawals mocks base method.
-func (m *MockStorage) LoadWithdrawals(arg0 context.Context, arg1 string) ([]byte, error) {
+func (m *MockStorage) LoadWithdrawals(arg0 context.Context, arg1 string, arg2 orders.Filter) ([]orders.Withdrawal, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "LoadWithdrawals", arg0, arg1)
-	ret0, _ := ret[0].([]byte)
+	ret := m.ctrl.Call(m, "LoadWithdrawals", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]orders.Withdrawal)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // LoadWithdrawals indicates an expected call of LoadWithdrawals.
-func (mr *MockStorageMockRecorder) LoadWithdrawals(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) LoadWithdrawals(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadWithdrawals", reflect.TypeOf((*MockStorage)(nil).LoadWithdrawals), arg0, arg1, arg2)
+}
+
+// LoginAttempts mocks base method.
+func (m *MockStorage) LoginAttempts(arg0 context.Context, arg1 []string, arg2 time.Time) (map[string]auth.Attempts, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoginAttempts", arg0, arg1, arg2)
+	ret0, _ := ret[0].(map[string]auth.Attempts)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoginAttempts indicates an expected call of LoginAttempts.
+func (mr *MockStorageMockRecorder) LoginAttempts(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginAttempts", reflect.TypeOf((*MockStorage)(nil).LoginAttempts), arg0, arg1, arg2)
+}
+
+// MarkStale mocks base method.
+func (m *MockStorage) MarkStale(arg0 context.Context, arg1 []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkStale", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkStale indicates an expected call of MarkStale.
+func (mr *MockStorageMockRecorder) MarkStale(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadWithdrawals", reflect.TypeOf((*MockStorage)(nil).LoadWithdrawals), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkStale", reflect.TypeOf((*MockStorage)(nil).MarkStale), arg0, arg1)
 }
 
 // OrdersToProcess mocks base method.
-func (m *MockStorage) OrdersToProcess(arg0 context.Context) (map[string]string, error) {
+func (m *MockStorage) OrdersToProcess(arg0 context.Context, arg1 string, arg2 int, arg3 time.Duration) ([]orders.Job, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "OrdersToProcess", arg0)
-	ret0, _ := ret[0].(map[string]string)
+	ret := m.ctrl.Call(m, "OrdersToProcess", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]orders.Job)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // OrdersToProcess indicates an expected call of OrdersToProcess.
-func (mr *MockStorageMockRecorder) OrdersToProcess(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) OrdersToProcess(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OrdersToProcess", reflect.TypeOf((*MockStorage)(nil).OrdersToProcess), arg0, arg1, arg2, arg3)
+}
+
+// PostponePolling mocks base method.
+func (m *MockStorage) PostponePolling(arg0 context.Context, arg1 string, arg2 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PostponePolling", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PostponePolling indicates an expected call of PostponePolling.
+func (mr *MockStorageMockRecorder) PostponePolling(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PostponePolling", reflect.TypeOf((*MockStorage)(nil).PostponePolling), arg0, arg1, arg2)
+}
+
+// RecordLoginFailure mocks base method.
+func (m *MockStorage) RecordLoginFailure(arg0 context.Context, arg1 string, arg2 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLoginFailure", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordLoginFailure indicates an expected call of RecordLoginFailure.
+func (mr *MockStorageMockRecorder) RecordLoginFailure(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OrdersToProcess", reflect.TypeOf((*MockStorage)(nil).OrdersToProcess), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLoginFailure", reflect.TypeOf((*MockStorage)(nil).RecordLoginFailure), arg0, arg1, arg2)
+}
+
+// RegisterEvent mocks base method.
+func (m *MockStorage) RegisterEvent(arg0 context.Context, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterEvent", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RegisterEvent indicates an expected call of RegisterEvent.
+func (mr *MockStorageMockRecorder) RegisterEvent(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterEvent", reflect.TypeOf((*MockStorage)(nil).RegisterEvent), arg0, arg1)
+}
+
+// RejectedTransitions mocks base method.
+func (m *MockStorage) RejectedTransitions() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RejectedTransitions")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// RejectedTransitions indicates an expected call of RejectedTransitions.
+func (mr *MockStorageMockRecorder) RejectedTransitions() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RejectedTransitions", reflect.TypeOf((*MockStorage)(nil).RejectedTransitions))
+}
+
+// ReleaseIdempotencyKey mocks base method.
+func (m *MockStorage) ReleaseIdempotencyKey(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseIdempotencyKey", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseIdempotencyKey indicates an expected call of ReleaseIdempotencyKey.
+func (mr *MockStorageMockRecorder) ReleaseIdempotencyKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).ReleaseIdempotencyKey), arg0, arg1, arg2)
+}
+
+// RescheduleOrders mocks base method.
+func (m *MockStorage) RescheduleOrders(arg0 context.Context, arg1 string, arg2 map[string]time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RescheduleOrders", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RescheduleOrders indicates an expected call of RescheduleOrders.
+func (mr *MockStorageMockRecorder) RescheduleOrders(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RescheduleOrders", reflect.TypeOf((*MockStorage)(nil).RescheduleOrders), arg0, arg1, arg2)
+}
+
+// ReserveIdempotencyKey mocks base method.
+func (m *MockStorage) ReserveIdempotencyKey(arg0 context.Context, arg1, arg2, arg3 string, arg4 time.Duration) (idempotency.Record, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReserveIdempotencyKey", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(idempotency.Record)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ReserveIdempotencyKey indicates an expected call of ReserveIdempotencyKey.
+func (mr *MockStorageMockRecorder) ReserveIdempotencyKey(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReserveIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).ReserveIdempotencyKey), arg0, arg1, arg2, arg3, arg4)
+}
+
+// ResetLoginFailures mocks base method.
+func (m *MockStorage) ResetLoginFailures(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetLoginFailures", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetLoginFailures indicates an expected call of ResetLoginFailures.
+func (mr *MockStorageMockRecorder) ResetLoginFailures(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetLoginFailures", reflect.TypeOf((*MockStorage)(nil).ResetLoginFailures), arg0, arg1)
+}
+
+// RevokeOtherSessions mocks base method.
+func (m *MockStorage) RevokeOtherSessions(arg0 context.Context, arg1, arg2 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeOtherSessions", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RevokeOtherSessions indicates an expected call of RevokeOtherSessions.
+func (mr *MockStorageMockRecorder) RevokeOtherSessions(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeOtherSessions", reflect.TypeOf((*MockStorage)(nil).RevokeOtherSessions), arg0, arg1, arg2)
+}
+
+// RevokeSession mocks base method.
+func (m *MockStorage) RevokeSession(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeSession", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeSession indicates an expected call of RevokeSession.
+func (mr *MockStorageMockRecorder) RevokeSession(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeSession", reflect.TypeOf((*MockStorage)(nil).RevokeSession), arg0, arg1, arg2)
+}
+
+// RevokedSessions mocks base method.
+func (m *MockStorage) RevokedSessions(arg0 context.Context, arg1 time.Time) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokedSessions", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RevokedSessions indicates an expected call of RevokedSessions.
+func (mr *MockStorageMockRecorder) RevokedSessions(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokedSessions", reflect.TypeOf((*MockStorage)(nil).RevokedSessions), arg0, arg1)
+}
+
+// RotateRefreshToken mocks base method.
+func (m *MockStorage) RotateRefreshToken(arg0 context.Context, arg1, arg2, arg3 string) (string, time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateRefreshToken", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(time.Time)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// RotateRefreshToken indicates an expected call of RotateRefreshToken.
+func (mr *MockStorageMockRecorder) RotateRefreshToken(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateRefreshToken", reflect.TypeOf((*MockStorage)(nil).RotateRefreshToken), arg0, arg1, arg2, arg3)
 }
 
 // StoreOrder mocks base method.
-func (m *MockStorage) StoreOrder(arg0 context.Context, arg1, arg2 string) error {
+func (m *MockStorage) StoreOrder(arg0 context.Context, arg1, arg2 string, arg3 time.Time) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "StoreOrder", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "StoreOrder", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // StoreOrder indicates an expected call of StoreOrder.
-func (mr *MockStorageMockRecorder) StoreOrder(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) StoreOrder(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreOrder", reflect.TypeOf((*MockStorage)(nil).StoreOrder), arg0, arg1, arg2, arg3)
+}
+
+// TouchSessions mocks base method.
+func (m *MockStorage) TouchSessions(arg0 context.Context, arg1 map[string]time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchSessions", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TouchSessions indicates an expected call of TouchSessions.
+func (mr *MockStorageMockRecorder) TouchSessions(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreOrder", reflect.TypeOf((*MockStorage)(nil).StoreOrder), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchSessions", reflect.TypeOf((*MockStorage)(nil).TouchSessions), arg0, arg1)
 }
 
 // UpdateBalances mocks base method.
@@ -155,6 +493,20 @@ func (mr *MockStorageMockRecorder) UpdateBalances(arg0 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateBalances", reflect.TypeOf((*MockStorage)(nil).UpdateBalances), arg0)
 }
 
+// UpdatePasswordHash mocks base method.
+func (m *MockStorage) UpdatePasswordHash(arg0 context.Context, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePasswordHash", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdatePasswordHash indicates an expected call of UpdatePasswordHash.
+func (mr *MockStorageMockRecorder) UpdatePasswordHash(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePasswordHash", reflect.TypeOf((*MockStorage)(nil).UpdatePasswordHash), arg0, arg1, arg2)
+}
+
 // UpdateStatuses mocks base method.
 func (m *MockStorage) UpdateStatuses(arg0 context.Context, arg1 []orders.Status) error {
 	m.ctrl.T.Helper()
@@ -185,7 +537,7 @@ func (mr *MockStorageMockRecorder) UserExists(arg0, arg1 interface{}) *gomock.Ca
 }
 
 // Withdraw mocks base method.
-func (m *MockStorage) Withdraw(arg0 context.Context, arg1, arg2 string, arg3 float64) error {
+func (m *MockStorage) Withdraw(arg0 context.Context, arg1, arg2 string, arg3 money.Amount) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Withdraw", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
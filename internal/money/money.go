@@ -0,0 +1,177 @@
+// Package money represents loyalty point amounts exactly
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of minor units in one point
+const Scale = 100
+
+// ErrPrecision is returned by ParseExact for amounts with digits beyond the minor unit
+var ErrPrecision = errors.New("amount is more precise than the minor unit")
+
+// Amount is a number of points stored in minor units (hundredths of a point),
+// so sums and comparisons are exact. It is encoded to JSON as a plain number, e.g. 500.5
+type Amount int64
+
+// Points returns an amount of whole points
+func Points(p int64) Amount {
+	return Amount(p * Scale)
+}
+
+// Parse reads a decimal number like 500.5 or 5.005e2.
+// Digits beyond the minor unit are rounded half away from zero.
+func Parse(s string) (Amount, error) {
+	r, err := parseUnits(s)
+	if err != nil {
+		return 0, err
+	}
+
+	// round half away from zero: (2*num + sign*den) / (2*den) truncated
+	num := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	den := new(big.Int).Mul(r.Denom(), big.NewInt(2))
+
+	if num.Sign() < 0 {
+		num.Sub(num, r.Denom())
+	} else {
+		num.Add(num, r.Denom())
+	}
+
+	num.Quo(num, den)
+
+	if !num.IsInt64() {
+		return 0, fmt.Errorf("amount %q is out of range", s)
+	}
+
+	return Amount(num.Int64()), nil
+}
+
+// ParseExact reads a decimal number like Parse but fails with ErrPrecision
+// instead of rounding digits beyond the minor unit
+func ParseExact(s string) (Amount, error) {
+	r, err := parseUnits(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%w: %q", ErrPrecision, s)
+	}
+
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("amount %q is out of range", s)
+	}
+
+	return Amount(r.Num().Int64()), nil
+}
+
+// parseUnits reads a decimal number as a number of minor units
+func parseUnits(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+
+	return r.Mul(r, big.NewRat(Scale, 1)), nil
+}
+
+// String formats the amount with no trailing zeros in the fraction
+func (a Amount) String() string {
+	var sign string
+
+	units := uint64(a)
+	if a < 0 {
+		sign = "-"
+		units = uint64(-(a + 1)) + 1 // math.MinInt64 safe negation
+	}
+
+	s := sign + strconv.FormatUint(units/Scale, 10)
+
+	if frac := units % Scale; frac != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%02d", frac), "0")
+	}
+
+	return s
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	return a.unmarshal(data, Parse)
+}
+
+// UnmarshalExactJSON decodes the amount like UnmarshalJSON but rejects digits beyond
+// the minor unit with ErrPrecision. Empty data is left as no amount like null.
+func (a *Amount) UnmarshalExactJSON(data []byte) error {
+	return a.unmarshal(data, ParseExact)
+}
+
+func (a *Amount) unmarshal(data []byte, parse func(string) (Amount, error)) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		return fmt.Errorf("amount must be a number, got %s", data)
+	}
+
+	v, err := parse(string(data))
+	if err != nil {
+		return err
+	}
+
+	*a = v
+
+	return nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns
+func (a *Amount) Scan(src interface{}) error {
+	var (
+		v   Amount
+		err error
+	)
+
+	switch src := src.(type) {
+	case nil:
+		v = 0
+	case int64:
+		if src > math.MaxInt64/Scale || src < math.MinInt64/Scale {
+			return fmt.Errorf("amount %v is out of range", src)
+		}
+
+		v = Points(src)
+	case float64:
+		v, err = Parse(strconv.FormatFloat(src, 'f', -1, 64))
+	case string:
+		v, err = Parse(src)
+	case []byte:
+		v, err = Parse(string(src))
+	default:
+		return fmt.Errorf("cannot scan %T into money.Amount", src)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	*a = v
+
+	return nil
+}
+
+// Value implements driver.Valuer, amounts are passed to the database as decimal strings
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
@@ -0,0 +1,141 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{in: "500.5", want: 50050},
+		{in: "500", want: 50000},
+		{in: "0.1", want: 10},
+		{in: "5.005e2", want: 50050},
+		{in: "0.005", want: 1},
+		{in: "0.004", want: 0},
+		{in: "-0.005", want: -1},
+		{in: "-12.34", want: -1234},
+		{in: "abc", wantErr: true},
+		{in: "1e30", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseExact(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr error
+	}{
+		{in: "500.5", want: 50050},
+		{in: "0.01", want: 1},
+		{in: "5.005e2", want: 50050},
+		{in: "0.10", want: 10},
+		{in: "0.005", wantErr: ErrPrecision},
+		{in: "729.981", wantErr: ErrPrecision},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseExact(tt.in)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := ParseExact("abc")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrPrecision)
+
+	_, err = ParseExact("1e30")
+	assert.Error(t, err)
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "500.5", Amount(50050).String())
+	assert.Equal(t, "500", Amount(50000).String())
+	assert.Equal(t, "0.05", Amount(5).String())
+	assert.Equal(t, "-1.2", Amount(-120).String())
+	assert.Equal(t, "0", Amount(0).String())
+	assert.Equal(t, "-92233720368547758.08", Amount(math.MinInt64).String())
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Sum Amount `json:"sum"`
+	}
+
+	require.NoError(t, json.Unmarshal([]byte(`{"sum": 729.98}`), &v))
+	assert.Equal(t, Amount(72998), v.Sum)
+
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"sum": 729.98}`, string(data))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": "729.98"}`), &v))
+
+	var a Amount
+	require.NoError(t, a.UnmarshalExactJSON([]byte(`729.98`)))
+	assert.Equal(t, Amount(72998), a)
+	assert.ErrorIs(t, a.UnmarshalExactJSON([]byte(`0.005`)), ErrPrecision)
+	assert.Error(t, a.UnmarshalExactJSON([]byte(`"1"`)))
+}
+
+func TestSum(t *testing.T) {
+	// 0.1 + 0.2 is exactly 0.3 unlike float64
+	a, _ := Parse("0.1")
+	b, _ := Parse("0.2")
+	c, _ := Parse("0.3")
+
+	assert.Equal(t, c, a+b)
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Amount
+	}{
+		{src: "123.45", want: 12345},
+		{src: []byte("0.10"), want: 10},
+		{src: int64(7), want: 700},
+		{src: 0.3, want: 30},
+		{src: nil, want: 0},
+	}
+
+	for _, tt := range tests {
+		a := Amount(1)
+		require.NoError(t, a.Scan(tt.src))
+		assert.Equal(t, tt.want, a)
+	}
+
+	v, err := Amount(12345).Value()
+	require.NoError(t, err)
+	assert.Equal(t, "123.45", v)
+}
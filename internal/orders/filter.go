@@ -0,0 +1,103 @@
+package orders
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Cursor points at the last item of a page. Items are ordered by time and then by number.
+	Cursor struct {
+		At     time.Time
+		Number string
+	}
+
+	// Filter selects a page of orders or withdrawals of a user
+	Filter struct {
+		// Limit is the maximum number of items, zero means no limit
+		Limit int
+		// After skips items up to the cursor including it
+		After *Cursor
+		// Statuses the orders must be in, any status if empty
+		Statuses []string
+		// From and To bound the time of items, To is exclusive. Zero values mean no bound.
+		From, To time.Time
+		// Desc orders items from the newest to the oldest
+		Desc bool
+	}
+)
+
+// Encode returns an opaque string representation of the cursor
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.At.UnixNano(), 10) + ":" + c.Number))
+}
+
+// ParseCursor decodes a cursor returned by Encode
+func ParseCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return Cursor{At: time.Unix(0, nanos).UTC(), Number: parts[1]}, nil
+}
+
+// Match returns true if the item with the given time, number and status passes the filter.
+// Limit is not taken into account.
+func (f Filter) Match(at time.Time, number, status string) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+
+		for _, s := range f.Statuses {
+			if s == status {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if !f.From.IsZero() && at.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !at.Before(f.To) {
+		return false
+	}
+
+	if f.After != nil {
+		if f.Desc {
+			return Less(at, number, f.After.At, f.After.Number)
+		}
+
+		return Less(f.After.At, f.After.Number, at, number)
+	}
+
+	return true
+}
+
+// Less tells if the item a goes before the item b in the ascending order
+func Less(aAt time.Time, aNumber string, bAt time.Time, bNumber string) bool {
+	if !aAt.Equal(bAt) {
+		return aAt.Before(bAt)
+	}
+
+	return aNumber < bNumber
+}
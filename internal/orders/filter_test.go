@@ -0,0 +1,36 @@
+package orders
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	c := Cursor{At: time.Date(2022, 9, 1, 12, 30, 0, 123456000, time.UTC), Number: "12345678903"}
+
+	got, err := ParseCursor(c.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, c, got)
+
+	for _, s := range []string{"", "!!!", Cursor{}.Encode()[:4]} {
+		_, err := ParseCursor(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	at := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.True(t, Filter{}.Match(at, "2", StatusNew))
+	assert.False(t, Filter{Statuses: []string{StatusProcessed}}.Match(at, "2", StatusNew))
+	assert.False(t, Filter{From: at.Add(time.Second)}.Match(at, "2", StatusNew))
+	assert.False(t, Filter{To: at}.Match(at, "2", StatusNew))
+
+	// items with the same time are ordered by number
+	assert.True(t, Filter{After: &Cursor{At: at, Number: "1"}}.Match(at, "2", StatusNew))
+	assert.False(t, Filter{After: &Cursor{At: at, Number: "2"}}.Match(at, "2", StatusNew))
+	assert.True(t, Filter{After: &Cursor{At: at, Number: "3"}, Desc: true}.Match(at, "2", StatusNew))
+}
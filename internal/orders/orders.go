@@ -1,49 +1,76 @@
 package orders
 
 import (
-	"strconv"
 	"time"
+
+	"github.com/usa4ev/gophermart/internal/money"
+)
+
+const (
+	StatusNew        = "NEW"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+	// StatusStale is set to orders the accrual system failed to process in time
+	StatusStale = "STALE"
 )
 
 type (
-	Status struct {
-		Order   string  `json:"order"`
-		Status  string  `json:"status"`
-		Accrual float64 `json:"accrual"`
+	// Order is an order uploaded by a user
+	Order struct {
+		Number     string       `json:"number"`
+		Status     string       `json:"status"`
+		Accrual    money.Amount `json:"accrual,omitempty"`
+		UploadedAt time.Time    `json:"uploaded_at"`
 	}
 
-	Withdrawal struct {
-		Order       string    `json:"order"`
-		Sum         float64   `json:"sum"`
-		ProcessedAt time.Time `json:"processed_at,omitempty"`
+	// Transition is a change of the order status
+	Transition struct {
+		Status  string       `json:"status"`
+		Accrual money.Amount `json:"accrual,omitempty"`
+		At      time.Time    `json:"at"`
 	}
-)
 
-func OrderNumValid(orderNum string) bool {
-	origNumber, err := strconv.ParseInt(orderNum, 10, 64)
-	if err != nil {
-		return false
+	// Details is an order with the history of its statuses from the oldest to the newest
+	Details struct {
+		Order
+		History []Transition `json:"history"`
 	}
 
-	// Luhn algorithm validation
-	var luhn int64
-
-	control := origNumber % 10
-	number := origNumber / 10
+	Status struct {
+		Order   string       `json:"order"`
+		Status  string       `json:"status"`
+		Accrual money.Amount `json:"accrual"`
+	}
 
-	for i := 0; number > 0; i++ {
-		cur := number % 10
+	Withdrawal struct {
+		Order       string       `json:"order"`
+		Sum         money.Amount `json:"sum"`
+		ProcessedAt time.Time    `json:"processed_at,omitempty"`
+	}
 
-		if i%2 == 0 { // even
-			cur *= 2
-			if cur > 9 {
-				cur = cur%10 + cur/10
-			}
-		}
+	// StaleOrder is an order the accrual system failed to process in time
+	StaleOrder struct {
+		Number     string    `json:"number"`
+		Customer   string    `json:"customer"`
+		UploadedAt time.Time `json:"uploaded_at"`
+	}
 
-		luhn += cur
-		number /= 10
+	// Job is an order waiting for the accrual system to process it
+	Job struct {
+		Number     string
+		Status     string
+		Attempts   int
+		UploadedAt time.Time
 	}
+)
+
+// IsFinal returns true if the status is not going to change anymore
+func IsFinal(status string) bool {
+	return status == StatusInvalid || status == StatusProcessed || status == StatusStale
+}
 
-	return (control+luhn%10)%10 == 0
+// OrderNumValid checks the number with the Luhn algorithm regardless of its length
+func OrderNumValid(orderNum string) bool {
+	return Luhn{}.Valid(orderNum)
 }
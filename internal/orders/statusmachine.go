@@ -0,0 +1,99 @@
+package orders
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// AccrualRegistered is the accrual system status of an order it has not started processing yet
+const AccrualRegistered = "REGISTERED"
+
+var (
+	ErrUnknownStatus     = fmt.Errorf("unknown order status")
+	ErrIllegalTransition = fmt.Errorf("illegal order status transition")
+)
+
+// accrualStatuses maps statuses the accrual system reports to order statuses.
+// NEW and STALE are set by the service itself, so they are not accepted from outside.
+var accrualStatuses = map[string]string{
+	AccrualRegistered: StatusNew,
+	StatusProcessing:  StatusProcessing,
+	StatusInvalid:     StatusInvalid,
+	StatusProcessed:   StatusProcessed,
+}
+
+// StatusMachine maps statuses reported by the accrual system to order statuses
+// and tells which status changes are allowed. It counts rejected changes.
+type StatusMachine struct {
+	mapping     map[string]string
+	transitions map[string]map[string]bool
+	rejected    uint64
+}
+
+// AccrualStatus tells if the status can be reported by the accrual system
+func AccrualStatus(status string) bool {
+	_, ok := accrualStatuses[status]
+
+	return ok
+}
+
+// FromAccrual returns the order status the accrual system status is stored as,
+// false is returned for statuses the accrual system can not report
+func FromAccrual(status string) (string, bool) {
+	s, ok := accrualStatuses[status]
+
+	return s, ok
+}
+
+// NewStatusMachine returns the machine of the order lifecycle:
+// NEW → PROCESSING → INVALID | PROCESSED. Orders not processed in time become STALE
+// and may still be resolved by the accrual system later.
+func NewStatusMachine() *StatusMachine {
+	return &StatusMachine{
+		mapping: accrualStatuses,
+		transitions: map[string]map[string]bool{
+			StatusNew:        {StatusProcessing: true, StatusInvalid: true, StatusProcessed: true, StatusStale: true},
+			StatusProcessing: {StatusInvalid: true, StatusProcessed: true, StatusStale: true},
+			StatusStale:      {StatusInvalid: true, StatusProcessed: true},
+			StatusInvalid:    {},
+			StatusProcessed:  {},
+		},
+	}
+}
+
+// Next returns the status the order in the current status moves to.
+// The second result is false if there is nothing to change, e.g. a final status is reported again.
+// Unknown statuses and illegal transitions are counted and returned as errors.
+func (m *StatusMachine) Next(current string, s Status) (Status, bool, error) {
+	status, ok := m.mapping[s.Status]
+	if !ok {
+		atomic.AddUint64(&m.rejected, 1)
+
+		return s, false, fmt.Errorf("%w: %v", ErrUnknownStatus, s.Status)
+	}
+
+	s.Status = status
+
+	if current == status {
+		return s, !IsFinal(current), nil
+	}
+
+	if !m.transitions[current][status] {
+		atomic.AddUint64(&m.rejected, 1)
+
+		return s, false, fmt.Errorf("%w: %v → %v", ErrIllegalTransition, current, status)
+	}
+
+	return s, true, nil
+}
+
+// Stale tells if the order in the current status can be marked STALE.
+// Unlike statuses passed to Next it is set by the service, not reported by the accrual system.
+func (m *StatusMachine) Stale(current string) bool {
+	return m.transitions[current][StatusStale]
+}
+
+// Rejected returns the number of status changes rejected so far
+func (m *StatusMachine) Rejected() uint64 {
+	return atomic.LoadUint64(&m.rejected)
+}
@@ -0,0 +1,77 @@
+package orders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusMachine(t *testing.T) {
+	tests := []struct {
+		current   string
+		reported  string
+		want      string
+		wantApply bool
+		wantErr   error
+	}{
+		{current: StatusNew, reported: AccrualRegistered, want: StatusNew, wantApply: true},
+		{current: StatusNew, reported: StatusProcessing, want: StatusProcessing, wantApply: true},
+		{current: StatusProcessing, reported: StatusProcessing, want: StatusProcessing, wantApply: true},
+		{current: StatusProcessing, reported: StatusProcessed, want: StatusProcessed, wantApply: true},
+		{current: StatusStale, reported: StatusProcessed, want: StatusProcessed, wantApply: true},
+		{current: StatusProcessed, reported: StatusProcessed, want: StatusProcessed},
+		{current: StatusProcessed, reported: StatusProcessing, wantErr: ErrIllegalTransition},
+		{current: StatusProcessing, reported: AccrualRegistered, wantErr: ErrIllegalTransition},
+		{current: StatusInvalid, reported: StatusProcessed, wantErr: ErrIllegalTransition},
+		{current: StatusNew, reported: "DONE", wantErr: ErrUnknownStatus},
+		// statuses set by the service are not accepted from the accrual system
+		{current: StatusNew, reported: StatusNew, wantErr: ErrUnknownStatus},
+		{current: StatusProcessing, reported: StatusStale, wantErr: ErrUnknownStatus},
+	}
+
+	m := NewStatusMachine()
+	rejected := uint64(0)
+
+	for _, tt := range tests {
+		t.Run(tt.current+"→"+tt.reported, func(t *testing.T) {
+			got, apply, err := m.Next(tt.current, Status{Order: "1", Status: tt.reported})
+
+			if tt.wantErr != nil {
+				rejected++
+
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.False(t, apply)
+				assert.Equal(t, rejected, m.Rejected())
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Status)
+			assert.Equal(t, tt.wantApply, apply)
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	m := NewStatusMachine()
+
+	assert.True(t, m.Stale(StatusNew))
+	assert.True(t, m.Stale(StatusProcessing))
+	assert.False(t, m.Stale(StatusStale))
+	assert.False(t, m.Stale(StatusProcessed))
+	assert.False(t, m.Stale(StatusInvalid))
+
+	status, ok := FromAccrual(AccrualRegistered)
+	assert.True(t, ok)
+	assert.Equal(t, StatusNew, status)
+
+	_, ok = FromAccrual(StatusStale)
+	assert.False(t, ok)
+
+	assert.True(t, AccrualStatus(AccrualRegistered))
+	assert.True(t, AccrualStatus(StatusProcessed))
+	assert.False(t, AccrualStatus(StatusNew))
+	assert.False(t, AccrualStatus(StatusStale))
+}
@@ -0,0 +1,151 @@
+package orders
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Validator tells if the string is a valid order number
+	Validator interface {
+		Valid(number string) bool
+	}
+
+	// ValidatorFunc adapts a function to Validator
+	ValidatorFunc func(number string) bool
+
+	// Luhn accepts numbers of decimal digits with a valid Luhn checksum.
+	// Numbers with leading zeros are rejected as they would match other numbers
+	// once parsed as integers. Numbers longer than MaxLength digits are rejected, 0 means no limit.
+	Luhn struct {
+		MaxLength int
+	}
+
+	// PrefixRange accepts numbers starting with a prefix from From to To inclusive,
+	// e.g. 51-55. Both bounds have the same number of digits.
+	PrefixRange struct {
+		From, To string
+	}
+
+	// Prefixes accepts numbers matching any of the ranges
+	Prefixes []PrefixRange
+
+	// Length accepts numbers of Min to Max characters, 0 means no limit
+	Length struct {
+		Min, Max int
+	}
+
+	all []Validator
+)
+
+func (f ValidatorFunc) Valid(number string) bool {
+	return f(number)
+}
+
+// All returns Validator accepting numbers accepted by every one of validators
+func All(validators ...Validator) Validator {
+	return all(validators)
+}
+
+func (a all) Valid(number string) bool {
+	for _, v := range a {
+		if !v.Valid(number) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Valid checks the number digit by digit so it works for numbers of any length
+func (l Luhn) Valid(number string) bool {
+	if number == "" || number[0] == '0' || l.MaxLength > 0 && len(number) > l.MaxLength {
+		return false
+	}
+
+	// digits at odd positions counting from the check digit are doubled
+	double := len(number)%2 == 0
+	sum := 0
+
+	for i := 0; i < len(number); i++ {
+		d := int(number[i]) - '0'
+		if d < 0 || d > 9 {
+			return false
+		}
+
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+func (r PrefixRange) Valid(number string) bool {
+	if len(number) < len(r.From) {
+		return false
+	}
+
+	prefix := number[:len(r.From)]
+
+	return prefix >= r.From && prefix <= r.To
+}
+
+func (p Prefixes) Valid(number string) bool {
+	for _, r := range p {
+		if r.Valid(number) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l Length) Valid(number string) bool {
+	return len(number) >= l.Min && (l.Max == 0 || len(number) <= l.Max)
+}
+
+// ParsePrefixes parses comma separated prefixes and prefix ranges, e.g. "4,51-55,2221-2720"
+func ParsePrefixes(s string) (Prefixes, error) {
+	var res Prefixes
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		from, to, found := strings.Cut(v, "-")
+		if !found {
+			to = from
+		}
+
+		if !isDigits(from) || !isDigits(to) || len(from) != len(to) || from > to {
+			return nil, fmt.Errorf("invalid order number prefix range %q", v)
+		}
+
+		res = append(res, PrefixRange{From: from, To: to})
+	}
+
+	return res, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,113 @@
+package orders
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// referenceLuhn is the textbook Luhn check walking from the check digit to the left,
+// numbers with leading zeros are rejected
+func referenceLuhn(number string) bool {
+	if number == "" || strings.HasPrefix(number, "0") {
+		return false
+	}
+
+	sum := 0
+
+	for i := len(number) - 1; i >= 0; i-- {
+		if !strings.ContainsRune("0123456789", rune(number[i])) {
+			return false
+		}
+
+		d, _ := strconv.Atoi(number[i : i+1])
+		if (len(number)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d = d%10 + d/10
+			}
+		}
+
+		sum += d
+	}
+
+	return sum%10 == 0
+}
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		max    int
+		want   bool
+	}{
+		{number: "12345678903", want: true},
+		{number: "12345678904", want: false},
+		{number: "0", want: false},
+		{number: "00", want: false},
+		{number: "0012345678903", want: false},
+		{number: "79927398713", want: true},
+		{number: "12345678901234567890123456789012345678901234567895", want: true},
+		{number: "12345678901234567890123456789012345678901234567890", want: false},
+		{number: "12345678901234567890123456789012345678901234567895", max: 20, want: false},
+		{number: "", want: false},
+		{number: "+12345678903", want: false},
+		{number: "-12345678903", want: false},
+		{number: "1234567890 3", want: false},
+		{number: "1234567890a3", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			assert.Equal(t, tt.want, Luhn{MaxLength: tt.max}.Valid(tt.number))
+		})
+	}
+}
+
+func TestValidators(t *testing.T) {
+	prefixes, err := ParsePrefixes("4, 51-55")
+	require.NoError(t, err)
+
+	v := All(Luhn{}, Length{Min: 16, Max: 16}, prefixes)
+
+	assert.True(t, v.Valid("4111111111111111"))
+	assert.True(t, v.Valid("5500000000000004"))
+	assert.False(t, v.Valid("5600000000000002"), "prefix out of range")
+	assert.False(t, v.Valid("4111111111111112"), "invalid checksum")
+	assert.False(t, v.Valid("12345678903"), "wrong length")
+
+	assert.True(t, All().Valid("anything"))
+	assert.False(t, ValidatorFunc(func(string) bool { return false }).Valid("12345678903"))
+
+	for _, s := range []string{"5-1", "a", "51-5", "-"} {
+		_, err := ParsePrefixes(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func FuzzLuhn(f *testing.F) {
+	for _, seed := range []string{"12345678903", "0", "", "+1", "-0", "79927398713", "4111111111111111"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, number string) {
+		if got, want := (Luhn{}).Valid(number), referenceLuhn(number); got != want {
+			t.Errorf("Luhn{}.Valid(%q) = %v, reference = %v", number, got, want)
+		}
+	})
+}
+
+// FuzzLuhnNumbers checks numbers of digits of any length, which are rare among random strings
+func FuzzLuhnNumbers(f *testing.F) {
+	f.Add(uint64(1234567890), uint64(12345678903), uint8(3))
+
+	f.Fuzz(func(t *testing.T, a, b uint64, zeros uint8) {
+		number := strings.Repeat("0", int(zeros%8)) + strconv.FormatUint(a, 10) + strconv.FormatUint(b, 10)
+
+		if got, want := (Luhn{}).Valid(number), referenceLuhn(number); got != want {
+			t.Errorf("Luhn{}.Valid(%q) = %v, reference = %v", number, got, want)
+		}
+	})
+}
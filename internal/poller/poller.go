@@ -0,0 +1,287 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+type (
+	// Poller updates statuses of pending orders with a bounded pool of workers
+	// requesting the accrual system concurrently.
+	// Orders are leased from the storage so several pollers can share the queue.
+	Poller struct {
+		strg       storage
+		accrual    accrualClient
+		owner      string
+		workers    int
+		batchSize  int
+		lease      time.Duration
+		interval   time.Duration
+		maxBackoff time.Duration
+		maxAge     time.Duration
+	}
+
+	storage interface {
+		OrdersToProcess(ctx context.Context, owner string, limit int, lease time.Duration) ([]orders.Job, error)
+		RescheduleOrders(ctx context.Context, owner string, next map[string]time.Time) error
+		UpdateStatuses(ctx context.Context, batch []orders.Status) error
+		MarkStale(ctx context.Context, numbers []string) error
+	}
+
+	accrualClient interface {
+		OrderStatus(ctx context.Context, number string) (orders.Status, error)
+	}
+
+	config interface {
+		AccrualWorkers() int
+		AccrualBatchSize() int
+		AccrualLease() time.Duration
+		AccrualPollInterval() time.Duration
+		AccrualMaxBackoff() time.Duration
+		AccrualMaxAge() time.Duration
+	}
+
+	// result is an outcome of a single order poll,
+	// status is set only if it differs from the stored one.
+	// retryAt is set if the order is to be polled again not earlier than that.
+	result struct {
+		job     orders.Job
+		status  *orders.Status
+		stale   bool
+		retryAt time.Time
+	}
+)
+
+// New returns a Poller with the pool size and the batch size taken from cfg
+func New(strg storage, acc accrualClient, cfg config) *Poller {
+	p := &Poller{
+		strg:       strg,
+		accrual:    acc,
+		owner:      uuid.New().String(),
+		workers:    cfg.AccrualWorkers(),
+		batchSize:  cfg.AccrualBatchSize(),
+		lease:      cfg.AccrualLease(),
+		interval:   cfg.AccrualPollInterval(),
+		maxBackoff: cfg.AccrualMaxBackoff(),
+		maxAge:     cfg.AccrualMaxAge(),
+	}
+
+	if p.workers < 1 {
+		p.workers = 1
+	}
+
+	if p.batchSize < 1 {
+		p.batchSize = 1
+	}
+
+	if p.maxBackoff < p.interval {
+		p.maxBackoff = p.interval
+	}
+
+	return p
+}
+
+// Poll leases orders due to be polled batch by batch until the queue is drained
+// and stores the changed statuses in batches.
+// All the workers stop as soon as the accrual system limits requests or the circuit breaker opens.
+func (p *Poller) Poll(ctx context.Context) error {
+	pollCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	jobs := make(chan orders.Job)
+	results := make(chan result)
+	leaseErr := make(chan error, 1)
+
+	go func() {
+		defer close(jobs)
+		leaseErr <- p.feed(pollCtx, jobs)
+	}()
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			p.work(pollCtx, stop, jobs, results)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	err := p.collect(ctx, results)
+
+	stop()
+
+	if lErr := <-leaseErr; lErr != nil && !errors.Is(lErr, context.Canceled) && err == nil {
+		err = lErr
+	}
+
+	return err
+}
+
+// feed leases orders and passes them to the workers until there is nothing left or ctx is done
+func (p *Poller) feed(ctx context.Context, jobs chan<- orders.Job) error {
+	for {
+		pending, err := p.strg.OrdersToProcess(ctx, p.owner, p.batchSize, p.lease)
+		if err != nil {
+			return err
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for _, job := range pending {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// work requests statuses of the orders from jobs until the channel is closed or ctx is done.
+// Orders not processed by the accrual system within max age are marked stale.
+func (p *Poller) work(ctx context.Context, stop context.CancelFunc, jobs <-chan orders.Job, results chan<- result) {
+	for job := range jobs {
+		status, err := p.accrual.OrderStatus(ctx, job.Number)
+
+		var rlErr *accrual.RateLimitError
+		if errors.As(err, &rlErr) {
+			// limit's been reached, so we're done here for now.
+			// The order is polled again once the limit is lifted rather than when its lease expires.
+			results <- result{job: job, retryAt: rlErr.RetryAt}
+
+			stop()
+
+			return
+		} else if errors.Is(err, accrual.ErrCircuitOpen) {
+			// the accrual system is down, so we're done here for now.
+			// The order is backed off as after any failed poll rather than left until its lease expires.
+			results <- result{job: job}
+
+			stop()
+
+			return
+		} else if ctx.Err() != nil {
+			return
+		} else if err != nil && !errors.Is(err, accrual.ErrOrderNotRegistered) {
+			log.Printf("failed to get order %v status from accrual system: %v\n", job.Number, err)
+		}
+
+		res := result{job: job}
+
+		// statuses are compared as stored, e.g. REGISTERED is stored as NEW.
+		// Unknown ones are passed on for the storage to reject and count them.
+		if stored, ok := orders.FromAccrual(status.Status); err == nil && (!ok || job.Status != stored) {
+			res.status = &status
+		}
+
+		if (err != nil || !orders.IsFinal(status.Status)) && p.maxAge > 0 && time.Since(job.UploadedAt) > p.maxAge {
+			log.Printf("order %v has not been processed by accrual system since %v, giving up\n", job.Number, job.UploadedAt)
+
+			res.status, res.stale = nil, true
+		}
+
+		results <- res
+	}
+}
+
+// collect stores the results in batches until the channel is closed
+func (p *Poller) collect(ctx context.Context, results <-chan result) error {
+	var firstErr error
+
+	report := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		} else {
+			log.Printf("%v", err)
+		}
+	}
+
+	batch := make([]orders.Status, 0, p.batchSize)
+	stale := make([]string, 0)
+	polled := make(map[string]time.Time, p.batchSize)
+
+	flush := func() {
+		if len(batch) > 0 {
+			if err := p.strg.UpdateStatuses(ctx, batch); err != nil {
+				report(err)
+			}
+		}
+
+		if len(stale) > 0 {
+			if err := p.strg.MarkStale(ctx, stale); err != nil {
+				report(err)
+			}
+		}
+
+		if err := p.strg.RescheduleOrders(ctx, p.owner, polled); err != nil {
+			report(err)
+		}
+
+		batch = make([]orders.Status, 0, p.batchSize)
+		stale = make([]string, 0)
+		polled = make(map[string]time.Time, p.batchSize)
+	}
+
+	for res := range results {
+		if res.retryAt.IsZero() {
+			polled[res.job.Number] = time.Now().Add(p.backoff(res.job.Attempts))
+		} else {
+			polled[res.job.Number] = res.retryAt
+		}
+
+		if res.status != nil {
+			batch = append(batch, *res.status)
+		}
+
+		if res.stale {
+			stale = append(stale, res.job.Number)
+		}
+
+		if len(polled) >= p.batchSize {
+			flush()
+		}
+	}
+
+	if len(polled) > 0 {
+		flush()
+	}
+
+	return firstErr
+}
+
+// backoff returns the delay before the next poll of an order polled the given number of times:
+// the poll interval is doubled with every attempt up to max backoff and a half of it is randomised
+func (p *Poller) backoff(attempts int) time.Duration {
+	delay := p.interval
+	for i := 0; i < attempts && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+
+	if delay < 2 {
+		return delay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,262 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/money"
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+type (
+	testConfig struct {
+		workers   int
+		batchSize int
+	}
+
+	testStorage struct {
+		mu          sync.Mutex
+		pending     []orders.Job
+		batches     [][]orders.Status
+		stale       []string
+		rescheduled map[string]time.Time
+	}
+
+	testAccrual struct {
+		calls     int32
+		limitFrom int32
+		handle    func(number string) (orders.Status, error)
+	}
+)
+
+func (c testConfig) AccrualWorkers() int   { return c.workers }
+func (c testConfig) AccrualBatchSize() int { return c.batchSize }
+
+func (c testConfig) AccrualLease() time.Duration { return time.Minute }
+
+func (c testConfig) AccrualPollInterval() time.Duration { return time.Minute }
+
+func (c testConfig) AccrualMaxBackoff() time.Duration { return time.Hour }
+
+func (c testConfig) AccrualMaxAge() time.Duration { return 24 * time.Hour }
+
+// OrdersToProcess leases orders by removing them from pending
+func (s *testStorage) OrdersToProcess(ctx context.Context, owner string, limit int, lease time.Duration) ([]orders.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit > len(s.pending) {
+		limit = len(s.pending)
+	}
+
+	leased := s.pending[:limit]
+	s.pending = s.pending[limit:]
+
+	return leased, nil
+}
+
+func (s *testStorage) RescheduleOrders(ctx context.Context, owner string, next map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rescheduled == nil {
+		s.rescheduled = make(map[string]time.Time)
+	}
+
+	for number, ts := range next {
+		s.rescheduled[number] = ts
+	}
+
+	return nil
+}
+
+func (s *testStorage) UpdateStatuses(ctx context.Context, batch []orders.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches = append(s.batches, batch)
+
+	return nil
+}
+
+func (s *testStorage) MarkStale(ctx context.Context, numbers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stale = append(s.stale, numbers...)
+
+	return nil
+}
+
+func (a *testAccrual) OrderStatus(ctx context.Context, number string) (orders.Status, error) {
+	n := atomic.AddInt32(&a.calls, 1)
+	if a.handle != nil {
+		return a.handle(number)
+	}
+
+	if a.limitFrom > 0 && n >= a.limitFrom {
+		return orders.Status{}, &accrual.RateLimitError{RetryAt: time.Now().Add(2 * time.Hour)}
+	}
+
+	select {
+	case <-ctx.Done():
+		return orders.Status{}, ctx.Err()
+	case <-time.After(time.Millisecond):
+	}
+
+	return orders.Status{Order: number, Status: "PROCESSED", Accrual: money.Points(10)}, nil
+}
+
+func pendingOrders(n int) []orders.Job {
+	pending := make([]orders.Job, 0, n)
+	for i := 0; i < n; i++ {
+		pending = append(pending, orders.Job{Number: fmt.Sprint(i), Status: "NEW", UploadedAt: time.Now()})
+	}
+
+	return pending
+}
+
+func TestPoll(t *testing.T) {
+	t.Run("all orders stored in batches", func(t *testing.T) {
+		strg := &testStorage{pending: pendingOrders(95)}
+		acc := &testAccrual{}
+
+		p := New(strg, acc, testConfig{workers: 8, batchSize: 10})
+		require.NoError(t, p.Poll(context.Background()))
+
+		assert.Equal(t, int32(95), acc.calls)
+		assert.Len(t, strg.rescheduled, 95)
+		require.Len(t, strg.batches, 10)
+
+		total := 0
+		for _, b := range strg.batches {
+			assert.LessOrEqual(t, len(b), 10)
+			total += len(b)
+		}
+
+		assert.Equal(t, 95, total)
+	})
+
+	t.Run("unchanged statuses skipped", func(t *testing.T) {
+		strg := &testStorage{pending: []orders.Job{
+			{Number: "1", Status: "PROCESSED", UploadedAt: time.Now()},
+			{Number: "2", Status: "NEW", UploadedAt: time.Now()},
+			{Number: "3", Status: "NEW", UploadedAt: time.Now()},
+		}}
+		acc := &testAccrual{handle: func(number string) (orders.Status, error) {
+			if number == "3" {
+				// REGISTERED is stored as NEW
+				return orders.Status{Order: number, Status: orders.AccrualRegistered}, nil
+			}
+
+			return orders.Status{Order: number, Status: "PROCESSED", Accrual: money.Points(10)}, nil
+		}}
+
+		p := New(strg, acc, testConfig{workers: 2, batchSize: 10})
+		require.NoError(t, p.Poll(context.Background()))
+
+		require.Len(t, strg.batches, 1)
+		assert.Equal(t, []orders.Status{{Order: "2", Status: "PROCESSED", Accrual: money.Points(10)}}, strg.batches[0])
+		assert.Len(t, strg.rescheduled, 3)
+	})
+
+	t.Run("workers stop on rate limit", func(t *testing.T) {
+		strg := &testStorage{pending: pendingOrders(1000)}
+		acc := &testAccrual{limitFrom: 20}
+
+		p := New(strg, acc, testConfig{workers: 4, batchSize: 10})
+		require.NoError(t, p.Poll(context.Background()))
+
+		assert.Less(t, atomic.LoadInt32(&acc.calls), int32(30))
+
+		stored := 0
+		for _, b := range strg.batches {
+			stored += len(b)
+		}
+
+		assert.LessOrEqual(t, stored, 19)
+
+		// limited orders are polled again after the limit is lifted
+		limited := 0
+		for _, at := range strg.rescheduled {
+			if at.After(time.Now().Add(90 * time.Minute)) {
+				limited++
+			}
+		}
+
+		assert.GreaterOrEqual(t, limited, 1)
+		assert.Equal(t, stored+limited, len(strg.rescheduled))
+	})
+
+	t.Run("workers stop on open circuit", func(t *testing.T) {
+		strg := &testStorage{pending: pendingOrders(100)}
+		acc := &testAccrual{handle: func(number string) (orders.Status, error) {
+			return orders.Status{}, accrual.ErrCircuitOpen
+		}}
+
+		p := New(strg, acc, testConfig{workers: 1, batchSize: 10})
+		require.NoError(t, p.Poll(context.Background()))
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&acc.calls))
+		assert.Empty(t, strg.batches)
+
+		// the order is backed off, not left leased
+		require.Len(t, strg.rescheduled, 1)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), strg.rescheduled["0"], time.Minute)
+	})
+
+	t.Run("old orders marked stale", func(t *testing.T) {
+		strg := &testStorage{pending: []orders.Job{
+			{Number: "1", Status: "NEW", Attempts: 10, UploadedAt: time.Now().Add(-48 * time.Hour)},
+			{Number: "2", Status: "NEW", Attempts: 10, UploadedAt: time.Now().Add(-48 * time.Hour)},
+			{Number: "3", Status: "NEW", Attempts: 10, UploadedAt: time.Now()},
+		}}
+		acc := &testAccrual{handle: func(number string) (orders.Status, error) {
+			if number == "2" {
+				return orders.Status{Order: number, Status: "PROCESSED", Accrual: money.Points(10)}, nil
+			}
+
+			return orders.Status{}, accrual.ErrOrderNotRegistered
+		}}
+
+		p := New(strg, acc, testConfig{workers: 1, batchSize: 10})
+		require.NoError(t, p.Poll(context.Background()))
+
+		require.Len(t, strg.batches, 1)
+		assert.Equal(t, []orders.Status{{Order: "2", Status: "PROCESSED", Accrual: money.Points(10)}}, strg.batches[0])
+		assert.Equal(t, []string{"1"}, strg.stale)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	p := New(&testStorage{}, &testAccrual{}, testConfig{})
+
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 0, max: time.Minute},
+		{attempts: 1, max: 2 * time.Minute},
+		{attempts: 3, max: 8 * time.Minute},
+		{attempts: 10, max: time.Hour},
+		{attempts: 100, max: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempts), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := p.backoff(tt.attempts)
+				assert.GreaterOrEqual(t, delay, tt.max/2)
+				assert.Less(t, delay, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+const (
+	eventIDHeader   = "X-Event-ID"
+	signatureHeader = "X-Signature"
+	// maxEventSize limits accrual event body size
+	maxEventSize = 1 << 16
+)
+
+// AccrualEvent handler applies order status pushed by the accrual system.
+// The body must be signed with HMAC-SHA256 using the shared secret,
+// events are deduplicated by ID.
+func (srv Server) AccrualEvent(w http.ResponseWriter, r *http.Request) {
+	secret := srv.cfg.AccrualWebhookSecret()
+	if secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request message: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if !validSignature(secret, body, r.Header.Get(signatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+
+		return
+	}
+
+	eventID := r.Header.Get(eventIDHeader)
+	if eventID == "" {
+		http.Error(w, "event ID is missing", http.StatusBadRequest)
+
+		return
+	}
+
+	status := orders.Status{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode a message: %v", err), http.StatusBadRequest)
+
+		return
+	} else if status.Order == "" || status.Status == "" {
+		http.Error(w, "order and status are required", http.StatusBadRequest)
+
+		return
+	} else if !orders.AccrualStatus(status.Status) {
+		http.Error(w, fmt.Sprintf("unexpected status %v", status.Status), http.StatusBadRequest)
+
+		return
+	}
+
+	fresh, err := srv.strg.RegisterEvent(r.Context(), eventID)
+	if err != nil {
+		errtxt := fmt.Sprintf("failed to register accrual event: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	} else if !fresh {
+		// the event has already been applied
+		return
+	}
+
+	err = srv.strg.UpdateStatuses(r.Context(), []orders.Status{status})
+	if err != nil {
+		if err := srv.strg.ForgetEvent(r.Context(), eventID); err != nil {
+			log.Printf("%v\n", err)
+		}
+
+		errtxt := fmt.Sprintf("failed to update order status: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	if !orders.IsFinal(status.Status) {
+		// polling is a fallback for orders not pushed for too long
+		err = srv.strg.PostponePolling(r.Context(), status.Order, time.Now().Add(srv.cfg.AccrualPushWindow()))
+		if err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+}
+
+// validSignature checks that signature is "sha256=" followed by hex encoded HMAC-SHA256 of the body
+func validSignature(secret string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (srv Server) expireEvents() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	err := srv.strg.ExpireEvents(ctx, time.Now().Add(-srv.cfg.AccrualEventTTL()))
+	if err != nil {
+		log.Printf("%v\n", err)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/leader"
+)
+
+// AdminMW lets through requests bearing the admin token.
+// Admin API is disabled if the token is not configured.
+func (srv Server) AdminMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := srv.cfg.AdminToken()
+		if adminToken == "" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoadStaleOrders handler returns orders the accrual system failed to process in time
+func (srv Server) LoadStaleOrders(w http.ResponseWriter, r *http.Request) {
+	res, err := srv.strg.LoadStaleOrders(r.Context())
+	if err != nil {
+		errtxt := fmt.Sprintf("failed to get stale orders from database: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(res); err != nil {
+		errtxt := fmt.Sprintf("failed to encode answer: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	w.Header().Add("Content-Type", ctJSON)
+
+	w.Write(buf.Bytes())
+}
+
+type serviceStatus struct {
+	Accrual accrual.BreakerState `json:"accrual"`
+	Leader  leader.State         `json:"leader"`
+	// RejectedTransitions counts order statuses rejected as illegal since the start
+	RejectedTransitions uint64 `json:"rejected_transitions"`
+}
+
+// Status handler reports state of the background processes
+func (srv Server) Status(w http.ResponseWriter, r *http.Request) {
+	status := serviceStatus{
+		Accrual:             srv.accrual.BreakerState(),
+		Leader:              srv.elector.State(),
+		RejectedTransitions: srv.strg.RejectedTransitions(),
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(status); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode answer: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-Type", ctJSON)
+
+	w.Write(buf.Bytes())
+}
@@ -3,16 +3,19 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/usa4ev/gophermart/internal/money"
 	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
 )
 
 type balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
 }
 
 func (srv Server) LoadBalance(w http.ResponseWriter, r *http.Request) {
@@ -65,10 +68,14 @@ func (srv Server) Withdraw(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 
-	op := orders.Withdrawal{}
+	// the sum is decoded separately to reject sub-cent precision rather than round it
+	req := struct {
+		Order string          `json:"order"`
+		Sum   json.RawMessage `json:"sum"`
+	}{}
 
 	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&op)
+	err := dec.Decode(&req)
 	if err != nil {
 		errtxt := fmt.Sprintf("failed to decode a message: %v", err)
 		http.Error(w, errtxt, http.StatusBadRequest)
@@ -77,28 +84,45 @@ func (srv Server) Withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !orders.OrderNumValid(op.Order) {
-		errtxt := fmt.Sprintf("invalid order number: %v", err)
+	op := orders.Withdrawal{Order: req.Order}
+
+	err = op.Sum.UnmarshalExactJSON(req.Sum)
+	if errors.Is(err, money.ErrPrecision) {
+		errtxt := fmt.Sprintf("invalid sum: %v", err)
 		http.Error(w, errtxt, http.StatusUnprocessableEntity)
 		log.Printf(errtxt + "\n")
 
+		return
+	} else if err != nil {
+		errtxt := fmt.Sprintf("failed to decode a message: %v", err)
+		http.Error(w, errtxt, http.StatusBadRequest)
+		log.Printf(errtxt + "\n")
+
 		return
 	}
 
-	if total, _, err := srv.strg.LoadBalance(r.Context(), userID); err != nil {
-		errtxt := fmt.Sprintf("failed to get balnce from database: %v", err)
-		http.Error(w, errtxt, http.StatusInternalServerError)
+	if !srv.validator.Valid(op.Order) {
+		errtxt := fmt.Sprintf("invalid order number: %v", op.Order)
+		http.Error(w, errtxt, http.StatusUnprocessableEntity)
 		log.Printf(errtxt + "\n")
 
 		return
-	} else if total < op.Sum {
-		http.Error(w, "not enough coins", http.StatusPaymentRequired)
+	}
+
+	if op.Sum <= 0 {
+		errtxt := fmt.Sprintf("withdrawal sum must be positive, got %v", op.Sum)
+		http.Error(w, errtxt, http.StatusUnprocessableEntity)
+		log.Printf(errtxt + "\n")
 
 		return
 	}
 
 	err = srv.strg.Withdraw(r.Context(), userID, op.Order, op.Sum)
-	if err != nil {
+	if errors.Is(err, storageerrs.ErrInsufficientFunds) {
+		http.Error(w, "not enough coins", http.StatusPaymentRequired)
+
+		return
+	} else if err != nil {
 		errtxt := fmt.Sprintf("failed to process a withdraw operation: %v", err)
 		http.Error(w, errtxt, http.StatusInternalServerError)
 		log.Printf(errtxt + "\n")
@@ -117,7 +141,14 @@ func (srv Server) LoadWithdrawals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := srv.strg.LoadWithdrawals(r.Context(), userID)
+	filter, err := parseFilter(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	res, err := srv.strg.LoadWithdrawals(r.Context(), userID, filter)
 	if err != nil {
 		errtxt := fmt.Sprintf("failed to get withdrawals from database: %v", err)
 		http.Error(w, errtxt, http.StatusInternalServerError)
@@ -126,7 +157,9 @@ func (srv Server) LoadWithdrawals(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Add("Content-Type", ctJSON)
+	res = res[:setNextCursor(w, filter, len(res), func(i int) orders.Cursor {
+		return orders.Cursor{At: res[i].ProcessedAt, Number: res[i].Order}
+	})]
 
-	w.Write(res)
+	writeList(w, res, len(res))
 }
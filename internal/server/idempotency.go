@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/idempotency"
+)
+
+const (
+	// maxIdempotencyKeyLen limits keys to what fits into the storage
+	maxIdempotencyKeyLen = 256
+	// maxIdempotentBodySize limits requests read into memory to fingerprint them
+	maxIdempotentBodySize = 1 << 20
+)
+
+// responseRecorder passes the response through and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	w.body.Write(b)
+
+	return w.ResponseWriter.Write(b)
+}
+
+// IdempotencyMW replays the saved response to a request retried with the same Idempotency-Key.
+// A key reused for a different request is rejected with 422, a key of a request
+// still being processed with 409. Responses with 5xx codes are not saved so the request can be retried.
+// The middleware must follow AuthorisationMW as keys are scoped by user.
+func (srv Server) IdempotencyMW(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency.Header)
+		if key == "" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, fmt.Sprintf("%v must not be longer than %v characters", idempotency.Header, maxIdempotencyKeyLen), http.StatusBadRequest)
+
+			return
+		}
+
+		userID, ok := r.Context().Value(srvCtxKey("userID")).(string)
+		if !ok {
+			errtxt := "request context is missing user ID"
+			http.Error(w, errtxt, http.StatusInternalServerError)
+			log.Printf(errtxt + "\n")
+
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil && len(body) == maxIdempotentBodySize {
+			// http.MaxBytesReader fails only after the whole limit is read
+			http.Error(w, fmt.Sprintf("request message must not be larger than %v bytes", maxIdempotentBodySize), http.StatusRequestEntityTooLarge)
+
+			return
+		} else if err != nil {
+			errtxt := fmt.Sprintf("failed to read request message: %v", err)
+			http.Error(w, errtxt, http.StatusBadRequest)
+			log.Printf(errtxt + "\n")
+
+			return
+		}
+
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := idempotency.Fingerprint(r.Method, r.URL.Path, body)
+
+		rec, reserved, err := srv.strg.ReserveIdempotencyKey(r.Context(), userID, key, fingerprint, srv.cfg.IdempotencyTTL())
+		if err != nil {
+			errtxt := fmt.Sprintf("failed to check idempotency key: %v", err)
+			http.Error(w, errtxt, http.StatusInternalServerError)
+			log.Printf(errtxt + "\n")
+
+			return
+		}
+
+		if !reserved {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				http.Error(w, fmt.Sprintf("%v is already used for a different request", idempotency.Header), http.StatusUnprocessableEntity)
+			case !rec.Completed:
+				http.Error(w, fmt.Sprintf("request with the same %v is being processed", idempotency.Header), http.StatusConflict)
+			default:
+				if rec.ContentType != "" {
+					w.Header().Set("Content-Type", rec.ContentType)
+				}
+
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				w.Write(rec.Body)
+			}
+
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// the request is done, the client must not lose the response because it was cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if recorder.status >= http.StatusInternalServerError {
+			err = srv.strg.ReleaseIdempotencyKey(ctx, userID, key)
+		} else {
+			err = srv.strg.CompleteIdempotencyKey(ctx, userID, key, idempotency.Record{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				Status:      recorder.status,
+				ContentType: recorder.Header().Get("Content-Type"),
+				Body:        recorder.body.Bytes(),
+			})
+		}
+
+		if err != nil {
+			log.Printf("failed to save idempotent response: %v\n", err)
+		}
+	})
+}
+
+func (srv Server) expireIdempotencyKeys() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	err := srv.strg.ExpireIdempotencyKeys(ctx, time.Now().Add(-srv.cfg.IdempotencyTTL()))
+	if err != nil {
+		log.Printf("%v\n", err)
+	}
+}
+
+// expRecords hourly removes idempotency keys and accrual events kept longer than their TTLs
+func (srv Server) expRecords() {
+	ticker := time.NewTicker(time.Hour)
+
+	for {
+		<-ticker.C
+		if srv.elector.IsLeader() {
+			srv.expireIdempotencyKeys()
+			srv.expireEvents()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usa4ev/gophermart/internal/orders"
+)
+
+const (
+	// maxPageSize limits the number of items requested at once
+	maxPageSize = 1000
+	// nextCursorHeader holds the cursor of the next page if there are more items
+	nextCursorHeader = "X-Next-Cursor"
+	dateLayout       = "2006-01-02"
+)
+
+// parseFilter reads the list query parameters:
+// limit, after (the cursor of the previous page), status (comma separated, orders only),
+// from and to (RFC 3339 time or date, to is inclusive for a date) and sort (asc or desc).
+// Without parameters the whole list is returned from the oldest to the newest as the specification requires.
+// A positive limit is increased by one so the handler can tell if there is the next page.
+func parseFilter(r *http.Request, withStatuses bool) (orders.Filter, error) {
+	q := r.URL.Query()
+	filter := orders.Filter{}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return filter, fmt.Errorf("limit must be a number from 1 to %v", maxPageSize)
+		}
+
+		filter.Limit = limit + 1
+	}
+
+	if v := q.Get("after"); v != "" {
+		cursor, err := orders.ParseCursor(v)
+		if err != nil {
+			return filter, err
+		}
+
+		filter.After = &cursor
+	}
+
+	if v := q.Get("status"); v != "" {
+		if !withStatuses {
+			return filter, fmt.Errorf("status filter is not supported")
+		}
+
+		for _, status := range strings.Split(v, ",") {
+			switch status {
+			case orders.StatusNew, orders.StatusProcessing, orders.StatusInvalid, orders.StatusProcessed, orders.StatusStale:
+				filter.Statuses = append(filter.Statuses, status)
+			default:
+				return filter, fmt.Errorf("unknown status %v", status)
+			}
+		}
+	}
+
+	var err error
+
+	if filter.From, err = parseTime(q.Get("from"), false); err != nil {
+		return filter, err
+	}
+
+	if filter.To, err = parseTime(q.Get("to"), true); err != nil {
+		return filter, err
+	}
+
+	switch q.Get("sort") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, fmt.Errorf("sort must be asc or desc")
+	}
+
+	return filter, nil
+}
+
+// parseTime reads RFC 3339 time or a date. The end of a range given by a date
+// is moved to the next day so the day is included.
+func parseTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(dateLayout, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %v, expected RFC 3339 time or YYYY-MM-DD date", v)
+	}
+
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// setNextCursor sets the cursor header if the page holds more items than requested
+// and returns the number of items to respond with
+func setNextCursor(w http.ResponseWriter, filter orders.Filter, length int, last func(i int) orders.Cursor) int {
+	if filter.Limit == 0 || length < filter.Limit {
+		return length
+	}
+
+	length = filter.Limit - 1
+	w.Header().Set(nextCursorHeader, last(length-1).Encode())
+
+	return length
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
@@ -12,7 +13,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi"
+
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/auth"
+	"github.com/usa4ev/gophermart/internal/auth/argon2hash"
+	"github.com/usa4ev/gophermart/internal/idempotency"
+	"github.com/usa4ev/gophermart/internal/leader"
+	"github.com/usa4ev/gophermart/internal/money"
 	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/poller"
+	"github.com/usa4ev/gophermart/internal/session"
 	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
 )
 
@@ -24,106 +35,169 @@ const (
 type (
 	Server struct {
 		strg    Storage
+		accrual AccrualClient
+		elector Elector
+		poller  *poller.Poller
 		cfg     config
 		running bool
+		// validator checks numbers of uploaded orders and orders paid with points
+		validator orders.Validator
+		// keys sign and verify session tokens
+		keys *session.KeyRing
+		// revoked caches revoked sessions so requests don't hit the storage
+		revoked *session.Revocations
+		// activity collects last seen times of sessions to save them in batches
+		activity *session.Activity
+		// limiter slows down password guessing
+		limiter *auth.Limiter
+		// hashParams are argon2id parameters of new password hashes, weaker hashes are upgraded on login
+		hashParams argon2hash.Params
+	}
+
+	serverOption func(srv *Server)
+
+	// AccrualClient gets order statuses from the accrual system
+	AccrualClient interface {
+		OrderStatus(ctx context.Context, number string) (orders.Status, error)
+		BreakerState() accrual.BreakerState
+	}
+
+	// Elector tells if the replica is the one to run singleton background jobs
+	Elector interface {
+		IsLeader() bool
+		State() leader.State
 	}
 
 	config interface {
 		SessionLifetime() time.Duration
-		AccrualSysAddr() string
+		AccrualWorkers() int
+		AccrualBatchSize() int
+		AccrualLease() time.Duration
+		AccrualPollInterval() time.Duration
+		AccrualMaxBackoff() time.Duration
+		AccrualMaxAge() time.Duration
+		AdminToken() string
+		AccrualWebhookSecret() string
+		AccrualPushWindow() time.Duration
+		IdempotencyTTL() time.Duration
+		AccrualEventTTL() time.Duration
+		OrderNumberMaxLength() int
+		RefreshTokenLifetime() time.Duration
+		RevocationRefreshInterval() time.Duration
+		LoginFreeAttempts() int
+		LoginMaxFailures() int
+		LoginIPMaxFailures() int
+		LoginBaseDelay() time.Duration
+		LoginLockout() time.Duration
+		Argon2Memory() uint32
+		Argon2Iterations() uint32
+		Argon2Parallelism() uint8
 	}
 
 	Storage interface {
-		StoreOrder(ctx context.Context, orderNum, userID string) error
-		LoadOrders(ctx context.Context, userID string) ([]byte, error)
-		LoadBalance(ctx context.Context, userID string) (float64, float64, error)
-		Withdraw(ctx context.Context, userID, number string, sum float64) error
-		LoadWithdrawals(ctx context.Context, userID string) ([]byte, error)
-		OrdersToProcess(ctx context.Context) (map[string]string, error)
+		StoreOrder(ctx context.Context, orderNum, userID string, pollAt time.Time) error
+		LoadOrders(ctx context.Context, userID string, filter orders.Filter) ([]orders.Order, error)
+		LoadOrder(ctx context.Context, userID, number string) (orders.Details, error)
+		LoadBalance(ctx context.Context, userID string) (money.Amount, money.Amount, error)
+		Withdraw(ctx context.Context, userID, number string, sum money.Amount) error
+		LoadWithdrawals(ctx context.Context, userID string, filter orders.Filter) ([]orders.Withdrawal, error)
+		OrdersToProcess(ctx context.Context, owner string, limit int, lease time.Duration) ([]orders.Job, error)
+		LoadStaleOrders(ctx context.Context) ([]orders.StaleOrder, error)
+		RescheduleOrders(ctx context.Context, owner string, next map[string]time.Time) error
+		PostponePolling(ctx context.Context, number string, until time.Time) error
+		RegisterEvent(ctx context.Context, id string) (bool, error)
+		ForgetEvent(ctx context.Context, id string) error
+		ExpireEvents(ctx context.Context, before time.Time) error
 		UpdateStatuses(ctx context.Context, batch []orders.Status) error
+		MarkStale(ctx context.Context, numbers []string) error
+		RejectedTransitions() uint64
 		UpdateBalances(ctx context.Context) error
+		ReserveIdempotencyKey(ctx context.Context, userID, key, fingerprint string, ttl time.Duration) (idempotency.Record, bool, error)
+		CompleteIdempotencyKey(ctx context.Context, userID, key string, rec idempotency.Record) error
+		ReleaseIdempotencyKey(ctx context.Context, userID, key string) error
+		ExpireIdempotencyKeys(ctx context.Context, before time.Time) error
 		AddUser(ctx context.Context, username, hash string) (string, error)
 		UserExists(ctx context.Context, userName string) (bool, error)
 		GetPasswordHash(ctx context.Context, userName string) (string, string, error)
+		UpdatePasswordHash(ctx context.Context, userID, hash string) error
+		CreateSession(ctx context.Context, userID, sessionID, refreshHash string, device session.Device, expiresAt time.Time) error
+		RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string) (string, time.Time, error)
+		RevokeSession(ctx context.Context, userID, sessionID string) error
+		RevokedSessions(ctx context.Context, since time.Time) ([]string, error)
+		LoadSessions(ctx context.Context, userID string) ([]session.Session, error)
+		RevokeOtherSessions(ctx context.Context, userID, keepID string) ([]string, error)
+		TouchSessions(ctx context.Context, seen map[string]time.Time) error
+		LoginAttempts(ctx context.Context, keys []string, since time.Time) (map[string]auth.Attempts, error)
+		RecordLoginFailure(ctx context.Context, key string, since time.Time) error
+		ResetLoginFailures(ctx context.Context, key string) error
 	}
 )
 
-// New return new Server with started background processes
-func New(strg Storage, cfg config) Server {
-	srv := Server{
-		strg: strg,
-		cfg:  cfg,
+// WithOrderValidator replaces the default Luhn check of order numbers,
+// e.g. to add merchant specific formats
+func WithOrderValidator(v orders.Validator) serverOption {
+	return func(srv *Server) {
+		srv.validator = v
 	}
-
-	srv.start()
-
-	return srv
 }
-func (srv Server) updateStatuses(servicePath string) {
-	if servicePath == "" {
-		log.Fatal("Accrual service path is not defined")
-	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	ordersToProcess, err := srv.strg.OrdersToProcess(ctx)
-	if err != nil {
-		log.Printf("failed to get orders to update status: %v\n", err)
+// WithKeyRing sets keys of session tokens. By default tokens are signed
+// with a random key and do not survive a restart.
+func WithKeyRing(keys *session.KeyRing) serverOption {
+	return func(srv *Server) {
+		srv.keys = keys
 	}
+}
 
-	batch := make([]orders.Status, 0)
-
-	for order, currentStatus := range ordersToProcess {
-
-		res, err := http.Get(servicePath + "/api/orders/" + order)
-		if err != nil {
-			log.Printf("failed to access accrual system: %v\n", err)
-
-			continue
-		}
-
-		defer res.Body.Close()
-
-		if res.StatusCode == http.StatusTooManyRequests {
-			// limit's been reached, so we're done here for now
-			break
-		} else if res.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(res.Body)
-			if err != nil {
-				log.Printf("failed to read accural system error response: %v\n", err)
-			}
-
-			log.Printf("unexpected response from accrual system. code: %v message: %v", res.StatusCode, string(body))
-
-			continue
-		}
-
-		status := orders.Status{}
-		dec := json.NewDecoder(res.Body)
-		err = dec.Decode(&status)
-		if err != nil {
-			log.Printf("failed to decode response of the accrual system: %v\n", err)
-
-			continue
-		}
-
-		if currentStatus == status.Status {
-			// nothing changed, needless to update this order
-			continue
-		}
+// New return new Server with started background processes
+func New(strg Storage, acc AccrualClient, elector Elector, cfg config, opts ...serverOption) Server {
+	srv := Server{
+		strg:      strg,
+		accrual:   acc,
+		elector:   elector,
+		poller:    poller.New(strg, acc, cfg),
+		cfg:       cfg,
+		validator: orders.Luhn{MaxLength: cfg.OrderNumberMaxLength()},
+		revoked:   session.NewRevocations(),
+		activity:  session.NewActivity(),
+	}
 
-		batch = append(batch, status)
+	srv.hashParams = argon2hash.DefaultParams()
+	srv.hashParams.Memory = cfg.Argon2Memory()
+	srv.hashParams.Iterations = cfg.Argon2Iterations()
+	srv.hashParams.Parallelism = cfg.Argon2Parallelism()
+
+	// an IP address may log in to several accounts, so it is delayed only after the user lockout
+	srv.limiter = auth.NewLimiter(strg,
+		auth.Policy{
+			FreeAttempts: cfg.LoginFreeAttempts(),
+			MaxFailures:  cfg.LoginMaxFailures(),
+			BaseDelay:    cfg.LoginBaseDelay(),
+			Lockout:      cfg.LoginLockout(),
+		},
+		auth.Policy{
+			FreeAttempts: cfg.LoginMaxFailures(),
+			MaxFailures:  cfg.LoginIPMaxFailures(),
+			BaseDelay:    cfg.LoginBaseDelay(),
+			Lockout:      cfg.LoginLockout(),
+		})
+
+	for _, o := range opts {
+		o(&srv)
 	}
 
-	if len(batch) == 0 {
-		// nothing to update
-		return
+	if srv.keys == nil {
+		srv.keys = session.NewEphemeralKeyRing()
 	}
 
-	err = srv.strg.UpdateStatuses(ctx, batch)
+	srv.start()
+
+	return srv
+}
+func (srv Server) updateStatuses() {
+	err := srv.poller.Poll(context.Background())
 	if err != nil {
-		log.Printf("%v", err)
+		log.Printf("failed to update order statuses: %v\n", err)
 	}
 }
 
@@ -143,18 +217,19 @@ func (srv Server) updBalances() {
 
 	for {
 		<-timer.C
-		srv.updateBalance()
+		if srv.elector.IsLeader() {
+			srv.updateBalance()
+		}
 		timer = time.NewTimer(time.Until(time.Now().AddDate(0, 0, 1).Round(24 * time.Hour)))
 	}
 }
 
 func (srv Server) updStatuses() {
-	// every 5 minutes
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(srv.cfg.AccrualPollInterval())
 
 	for {
 		<-ticker.C
-		srv.updateStatuses(srv.cfg.AccrualSysAddr())
+		srv.updateStatuses()
 	}
 }
 
@@ -163,8 +238,13 @@ func (srv Server) start() error {
 		return fmt.Errorf("server is already running")
 	}
 
+	// sessions revoked before a restart must be rejected right away
+	srv.loadRevocations()
+
 	go srv.updBalances()
 	go srv.updStatuses()
+	go srv.expRecords()
+	go srv.syncSessions()
 
 	return nil
 }
@@ -232,13 +312,19 @@ func (srv Server) StoreOrder(w http.ResponseWriter, r *http.Request) {
 
 	message := strings.TrimSpace(string(body))
 
-	if !orders.OrderNumValid(message) {
-		http.Error(w, fmt.Sprintf("invalid order number: %v", err), http.StatusUnprocessableEntity)
+	if !srv.validator.Valid(message) {
+		http.Error(w, fmt.Sprintf("invalid order number: %v", message), http.StatusUnprocessableEntity)
 
 		return
 	}
 
-	err = srv.strg.StoreOrder(r.Context(), message, userID)
+	pollAt := time.Now()
+	if srv.cfg.AccrualWebhookSecret() != "" {
+		// give the accrual system a chance to push the status before polling
+		pollAt = pollAt.Add(srv.cfg.AccrualPushWindow())
+	}
+
+	err = srv.strg.StoreOrder(r.Context(), message, userID, pollAt)
 	if errors.Is(err, storageerrs.ErrOrderExists) {
 		http.Error(w, err.Error(), http.StatusConflict)
 		log.Println(message)
@@ -268,7 +354,14 @@ func (srv Server) LoadOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := srv.strg.LoadOrders(r.Context(), userID)
+	filter, err := parseFilter(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	res, err := srv.strg.LoadOrders(r.Context(), userID, filter)
 	if err != nil {
 		errtxt := fmt.Sprintf("failed to get orders from database: %v", err)
 		http.Error(w, errtxt, http.StatusInternalServerError)
@@ -277,7 +370,81 @@ func (srv Server) LoadOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	res = res[:setNextCursor(w, filter, len(res), func(i int) orders.Cursor {
+		return orders.Cursor{At: res[i].UploadedAt, Number: res[i].Number}
+	})]
+
+	writeList(w, res, len(res))
+}
+
+// LoadOrder handler returns the user's order with its status history.
+// Orders of other users are reported as not found.
+func (srv Server) LoadOrder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(srvCtxKey("userID")).(string)
+	if !ok {
+		errtxt := "request context is missing user ID"
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	number := chi.URLParam(r, "number")
+	if !srv.validator.Valid(number) {
+		http.Error(w, fmt.Sprintf("invalid order number: %v", number), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	res, err := srv.strg.LoadOrder(r.Context(), userID, number)
+	if errors.Is(err, storageerrs.ErrNoResults) {
+		http.Error(w, "order not found", http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		errtxt := fmt.Sprintf("failed to get order from database: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+
+	if err := enc.Encode(res); err != nil {
+		errtxt := fmt.Sprintf("failed to encode answer: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	w.Header().Add("Content-Type", ctJSON)
+
+	w.Write(buf.Bytes())
+}
+
+// writeList encodes the list to JSON or responds with 204 if the list is empty
+func writeList(w http.ResponseWriter, list interface{}, length int) {
+	if length == 0 {
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+
+	if err := enc.Encode(list); err != nil {
+		errtxt := fmt.Sprintf("failed to encode answer: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
 	w.Header().Add("Content-Type", ctJSON)
 
-	w.Write(res)
+	w.Write(buf.Bytes())
 }
@@ -3,31 +3,48 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/usa4ev/gophermart/internal/accrual"
+	"github.com/usa4ev/gophermart/internal/auth"
 	conf "github.com/usa4ev/gophermart/internal/config"
+	"github.com/usa4ev/gophermart/internal/idempotency"
+	"github.com/usa4ev/gophermart/internal/leader"
 	"github.com/usa4ev/gophermart/internal/mocks"
+	"github.com/usa4ev/gophermart/internal/money"
+	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/session"
 	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
 )
 
 func TestRegister(t *testing.T) {
 	cfg := conf.New()
 	ctrl := gomock.NewController(t)
-	strg := mocks.NewMockStorage(ctrl)
+	strg := newMockStorage(ctrl)
 
 	// New test server
 	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
 	cl := newTestClient(ts)
 
 	tests := []struct {
@@ -67,7 +84,8 @@ func TestRegister(t *testing.T) {
 
 			strg.EXPECT().UserExists(gomock.Any(), tt.Login).Return(tt.exists, nil).Times(1)
 			if !tt.exists {
-				strg.EXPECT().AddUser(gomock.Any(), tt.Login, gomock.Any())
+				strg.EXPECT().AddUser(gomock.Any(), tt.Login, gomock.Any()).Return("userID", nil)
+				strg.EXPECT().CreateSession(gomock.Any(), "userID", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 			}
 
 			res, err := cl.Do(req)
@@ -89,10 +107,11 @@ func TestRegister(t *testing.T) {
 func TestLogin(t *testing.T) {
 	cfg := conf.New()
 	ctrl := gomock.NewController(t)
-	strg := mocks.NewMockStorage(ctrl)
+	strg := newMockStorage(ctrl)
 
 	// New test server
 	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
 	cl := newTestClient(ts)
 
 	tests := []struct {
@@ -127,7 +146,15 @@ func TestLogin(t *testing.T) {
 			req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/login", buf)
 			require.NoError(t, err)
 
+			strg.EXPECT().LoginAttempts(gomock.Any(), []string{"user:" + tt.Login, "ip:127.0.0.1"}, gomock.Any()).Return(nil, nil)
 			strg.EXPECT().GetPasswordHash(gomock.Any(), tt.Login).Return("userID", tt.hash, nil).Times(1)
+			if tt.hashValid {
+				strg.EXPECT().ResetLoginFailures(gomock.Any(), "user:"+tt.Login).Return(nil)
+				strg.EXPECT().CreateSession(gomock.Any(), "userID", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+			} else {
+				strg.EXPECT().RecordLoginFailure(gomock.Any(), "user:"+tt.Login, gomock.Any()).Return(nil)
+				strg.EXPECT().RecordLoginFailure(gomock.Any(), "ip:127.0.0.1", gomock.Any()).Return(nil)
+			}
 
 			res, err := cl.Do(req)
 			require.NoError(t, err)
@@ -148,13 +175,230 @@ func TestLogin(t *testing.T) {
 	}
 }
 
-func TestStoreOrder(t *testing.T) {
+func TestLoginLimit(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	// the user is locked out after too many failures, the password is not even checked
+	strg.EXPECT().LoginAttempts(gomock.Any(), []string{"user:testUser", "ip:127.0.0.1"}, gomock.Any()).Return(map[string]auth.Attempts{
+		"user:testUser": {Failures: cfg.LoginMaxFailures(), LastFailure: time.Now().Add(-time.Minute)},
+		"ip:127.0.0.1":  {Failures: 1, LastFailure: time.Now()},
+	}, nil)
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/login", strings.NewReader(`{"login": "testUser", "password": "111"}`))
+	require.NoError(t, err)
+
+	res, err := cl.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, (cfg.LoginLockout() - time.Minute).Seconds(), retryAfter, 2)
+}
+
+func TestAuthorisationMW(t *testing.T) {
 	cfg := conf.New()
 	ctrl := gomock.NewController(t)
 	strg := mocks.NewMockStorage(ctrl)
 
+	// sessions revoked before the start are loaded before serving requests
+	strg.EXPECT().RevokedSessions(gomock.Any(), gomock.Any()).Return([]string{"session0"}, nil).MinTimes(1)
+
+	srv := New(strg, accrual.New(cfg.AccrualSysAddr()), leader.NewStandalone(), cfg)
+
+	revoked, _, err := srv.keys.Open(session.Claims{UserID: "user1", SessionID: "session0"}, time.Minute)
+	require.NoError(t, err)
+
+	token, _, err := srv.keys.Open(session.Claims{UserID: "user1", SessionID: "session1"}, time.Minute)
+	require.NoError(t, err)
+
+	h := srv.AuthorisationMW(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value(srvCtxKey("userID")).(string)))
+	}))
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: accessCookie, Value: token})
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("not a token").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(revoked).Code, "token of session revoked before the start is accepted")
+
+	w := serve(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user1", w.Body.String())
+	assert.Contains(t, srv.activity.Flush(), "session1", "last seen time is not recorded")
+
+	srv.revoked.Add("session1")
+	assert.Equal(t, http.StatusUnauthorized, serve(token).Code, "token of revoked session is accepted")
+}
+
+func TestRefreshToken(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	srv := New(strg, accrual.New(cfg.AccrualSysAddr()), leader.NewStandalone(), cfg)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "rotated", wantCode: http.StatusOK},
+		{name: "revoked", err: storageerrs.ErrSessionRevoked, wantCode: http.StatusUnauthorized},
+		{name: "unknown", err: storageerrs.ErrNoResults, wantCode: http.StatusUnauthorized},
+		{name: "reused", err: storageerrs.ErrTokenReused, wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresh, hash, err := session.NewRefreshToken(tt.name)
+			require.NoError(t, err)
+
+			if tt.err != nil {
+				strg.EXPECT().RotateRefreshToken(gomock.Any(), tt.name, hash, gomock.Any()).Return("", time.Time{}, tt.err)
+			} else {
+				strg.EXPECT().RotateRefreshToken(gomock.Any(), tt.name, hash, gomock.Any()).Return("user1", expiresAt, nil)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", nil)
+			req.AddCookie(&http.Cookie{Name: refreshCookie, Value: refresh})
+
+			w := httptest.NewRecorder()
+			srv.RefreshToken(w, req)
+
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			assert.Equal(t, tt.err == storageerrs.ErrTokenReused, srv.revoked.Revoked(tt.name))
+
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			cookies := map[string]*http.Cookie{}
+			for _, c := range w.Result().Cookies() {
+				cookies[c.Name] = c
+			}
+
+			require.Contains(t, cookies, accessCookie)
+			require.Contains(t, cookies, refreshCookie)
+			assert.NotEqual(t, refresh, cookies[refreshCookie].Value)
+			assert.True(t, expiresAt.Equal(cookies[refreshCookie].Expires), "session lifetime is changed")
+
+			claims, err := srv.keys.Verify(cookies[accessCookie].Value)
+			require.NoError(t, err)
+			assert.Equal(t, session.Claims{UserID: "user1", SessionID: tt.name}, claims)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	srv.RefreshToken(w, httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogout(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	strg.EXPECT().RevokeSession(gomock.Any(), "TestUser", "TestSession").Return(nil)
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/logout", nil)
+	require.NoError(t, err)
+
+	res, err := cl.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	for _, c := range res.Cookies() {
+		assert.True(t, c.MaxAge < 0, "cookie %v is not removed", c.Name)
+	}
+
+	assert.Len(t, res.Cookies(), 2)
+}
+
+func TestSessions(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	srv := New(strg, accrual.New(cfg.AccrualSysAddr()), leader.NewStandalone(), cfg)
+	r := newRouter(srv)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+		return w
+	}
+
+	at := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	strg.EXPECT().LoadSessions(gomock.Any(), "TestUser").Return([]session.Session{
+		{ID: "TestSession", UserAgent: "laptop", IP: "10.0.0.2", CreatedAt: at, LastSeenAt: at.Add(time.Hour)},
+		{ID: "phone", UserAgent: "phone", IP: "10.0.0.1", CreatedAt: at, LastSeenAt: at},
+	}, nil)
+
+	w := serve(http.MethodGet, "/api/user/sessions")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `[
+		{"id": "TestSession", "user_agent": "laptop", "ip": "10.0.0.2", "created_at": "2022-09-01T12:00:00Z", "last_seen_at": "2022-09-01T13:00:00Z", "current": true},
+		{"id": "phone", "user_agent": "phone", "ip": "10.0.0.1", "created_at": "2022-09-01T12:00:00Z", "last_seen_at": "2022-09-01T12:00:00Z", "current": false}
+	]`, w.Body.String())
+
+	strg.EXPECT().RevokeSession(gomock.Any(), "TestUser", "phone").Return(nil)
+
+	w = serve(http.MethodDelete, "/api/user/sessions/phone")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, srv.revoked.Revoked("phone"))
+
+	strg.EXPECT().RevokeSession(gomock.Any(), "TestUser", "unknown").Return(storageerrs.ErrNoResults)
+
+	w = serve(http.MethodDelete, "/api/user/sessions/unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	strg.EXPECT().RevokeOtherSessions(gomock.Any(), "TestUser", "TestSession").Return([]string{"tablet", "tv"}, nil)
+
+	w = serve(http.MethodDelete, "/api/user/sessions/others")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, srv.revoked.Revoked("tablet"))
+	assert.True(t, srv.revoked.Revoked("tv"))
+	assert.False(t, srv.revoked.Revoked("TestSession"))
+}
+
+func TestStoreOrder(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
 	// New test server
 	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
 	cl := newTestClient(ts)
 
 	tests := []struct {
@@ -197,6 +441,22 @@ func TestStoreOrder(t *testing.T) {
 			conflict:   false,
 			orderValid: false,
 		},
+		{
+			name:       "new valid - longer than int64",
+			order:      "12345678901234567890123456789012345678901234567895",
+			wantCode:   http.StatusAccepted,
+			exists:     false,
+			conflict:   false,
+			orderValid: true,
+		},
+		{
+			name:       "new invalid - sign",
+			order:      "+12345678903",
+			wantCode:   http.StatusUnprocessableEntity,
+			exists:     false,
+			conflict:   false,
+			orderValid: false,
+		},
 		{
 			name:       "order already exists",
 			order:      "12345678903",
@@ -224,11 +484,721 @@ func TestStoreOrder(t *testing.T) {
 			if tt.orderValid {
 				number := strings.TrimSpace(tt.order)
 				if tt.exists {
-					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser").Return(storageerrs.ErrOrderLoaded).Times(1)
+					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser", gomock.Any()).Return(storageerrs.ErrOrderLoaded).Times(1)
 				} else if tt.conflict {
-					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser").Return(storageerrs.ErrOrderExists).Times(1)
+					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser", gomock.Any()).Return(storageerrs.ErrOrderExists).Times(1)
+				} else {
+					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser", gomock.Any()).Return(nil).Times(1)
+				}
+			}
+
+			res, err := cl.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			errTxt, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCode, res.StatusCode, string(errTxt))
+		})
+	}
+}
+
+func TestStoreOrderPushWindow(t *testing.T) {
+	cfg := conf.New(conf.WithEnvVars(map[string]string{"ACCRUAL_WEBHOOK_SECRET": "webhookSecret", "ACCRUAL_PUSH_WINDOW": "5m"}))
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	// the push window is set with the order so the poller can not lease it in between
+	strg.EXPECT().StoreOrder(gomock.Any(), "12345678903", "TestUser", gomock.Any()).
+		DoAndReturn(func(ctx context.Context, orderNum, userID string, pollAt time.Time) error {
+			assert.WithinDuration(t, time.Now().Add(5*time.Minute), pollAt, time.Minute)
+
+			return nil
+		}).Times(1)
+
+	res, err := cl.Post("http://"+cfg.RunAddress()+"/api/user/orders", "text/plain", strings.NewReader("12345678903"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+}
+
+func TestLoadOrders(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	uploaded := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		orders   []orders.Order
+		wantCode int
+		want     string
+	}{
+		{
+			name: "orders",
+			orders: []orders.Order{
+				{Number: "12345678903", Status: orders.StatusProcessed, Accrual: money.Amount(50050), UploadedAt: uploaded},
+				{Number: "2377225624", Status: orders.StatusNew, UploadedAt: uploaded},
+			},
+			wantCode: http.StatusOK,
+			want: `[{"number":"12345678903","status":"PROCESSED","accrual":500.5,"uploaded_at":"2022-09-01T00:00:00Z"},
+				{"number":"2377225624","status":"NEW","uploaded_at":"2022-09-01T00:00:00Z"}]`,
+		},
+		{
+			name:     "no orders",
+			orders:   []orders.Order{},
+			wantCode: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strg.EXPECT().LoadOrders(gomock.Any(), "TestUser", orders.Filter{}).Return(tt.orders, nil).Times(1)
+
+			res, err := cl.Get("http://" + cfg.RunAddress() + "/api/user/orders")
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCode, res.StatusCode, string(body))
+
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, string(body))
+			} else {
+				assert.Empty(t, body)
+			}
+		})
+	}
+}
+
+func TestLoadOrdersPage(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	uploaded := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	page := []orders.Order{
+		{Number: "1", Status: orders.StatusNew, UploadedAt: uploaded},
+		{Number: "2", Status: orders.StatusNew, UploadedAt: uploaded.Add(time.Second)},
+		{Number: "3", Status: orders.StatusNew, UploadedAt: uploaded.Add(2 * time.Second)},
+	}
+
+	after := orders.Cursor{At: uploaded.Add(-time.Hour), Number: "0"}
+
+	tests := []struct {
+		name       string
+		query      string
+		filter     orders.Filter
+		orders     []orders.Order
+		wantCode   int
+		wantLen    int
+		wantCursor string
+	}{
+		{
+			name:  "more items",
+			query: "?limit=2&status=NEW,PROCESSING&from=2022-09-01&to=2022-09-01&sort=desc&after=" + after.Encode(),
+			filter: orders.Filter{
+				Limit:    3,
+				After:    &after,
+				Statuses: []string{orders.StatusNew, orders.StatusProcessing},
+				From:     uploaded,
+				To:       uploaded.AddDate(0, 0, 1),
+				Desc:     true,
+			},
+			orders:     page,
+			wantCode:   http.StatusOK,
+			wantLen:    2,
+			wantCursor: orders.Cursor{At: page[1].UploadedAt, Number: "2"}.Encode(),
+		},
+		{
+			name:     "last page",
+			query:    "?limit=3",
+			filter:   orders.Filter{Limit: 4},
+			orders:   page,
+			wantCode: http.StatusOK,
+			wantLen:  3,
+		},
+		{
+			name:     "invalid limit",
+			query:    "?limit=0",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown status",
+			query:    "?status=DONE",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid cursor",
+			query:    "?after=abc",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCode == http.StatusOK {
+				strg.EXPECT().LoadOrders(gomock.Any(), "TestUser", tt.filter).Return(tt.orders, nil).Times(1)
+			}
+
+			res, err := cl.Get("http://" + cfg.RunAddress() + "/api/user/orders" + tt.query)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			require.Equal(t, tt.wantCode, res.StatusCode)
+			assert.Equal(t, tt.wantCursor, res.Header.Get("X-Next-Cursor"))
+
+			if tt.wantCode == http.StatusOK {
+				var got []orders.Order
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+				assert.Len(t, got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	uploaded := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	details := orders.Details{
+		Order: orders.Order{Number: "12345678903", Status: orders.StatusProcessed, Accrual: money.Points(500), UploadedAt: uploaded},
+		History: []orders.Transition{
+			{Status: orders.StatusNew, At: uploaded},
+			{Status: orders.StatusProcessing, At: uploaded.Add(time.Minute)},
+			{Status: orders.StatusProcessed, Accrual: money.Points(500), At: uploaded.Add(2 * time.Minute)},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		number   string
+		err      error
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "own order",
+			number:   "12345678903",
+			wantCode: http.StatusOK,
+			want: `{"number":"12345678903","status":"PROCESSED","accrual":500,"uploaded_at":"2022-09-01T00:00:00Z","history":[
+				{"status":"NEW","at":"2022-09-01T00:00:00Z"},
+				{"status":"PROCESSING","at":"2022-09-01T00:01:00Z"},
+				{"status":"PROCESSED","accrual":500,"at":"2022-09-01T00:02:00Z"}]}`,
+		},
+		{
+			name:     "order of another user",
+			number:   "12345678903",
+			err:      storageerrs.ErrNoResults,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid number",
+			number:   "12345678904",
+			wantCode: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCode != http.StatusUnprocessableEntity {
+				strg.EXPECT().LoadOrder(gomock.Any(), "TestUser", tt.number).Return(details, tt.err).Times(1)
+			}
+
+			res, err := cl.Get("http://" + cfg.RunAddress() + "/api/user/orders/" + tt.number)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCode, res.StatusCode, string(body))
+
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, string(body))
+			}
+		})
+	}
+}
+
+func TestLoadWithdrawals(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	processed := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	strg.EXPECT().LoadWithdrawals(gomock.Any(), "TestUser", orders.Filter{}).
+		Return([]orders.Withdrawal{{Order: "2377225624", Sum: money.Points(500), ProcessedAt: processed}}, nil).Times(1)
+
+	res, err := cl.Get("http://" + cfg.RunAddress() + "/api/user/balance/withdrawals")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	assert.JSONEq(t, `[{"order":"2377225624","sum":500,"processed_at":"2022-09-01T00:00:00Z"}]`, string(body))
+
+	// the newest first only on request
+	strg.EXPECT().LoadWithdrawals(gomock.Any(), "TestUser", orders.Filter{Desc: true}).Return(nil, nil).Times(1)
+
+	res, err = cl.Get("http://" + cfg.RunAddress() + "/api/user/balance/withdrawals?sort=desc")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestLoadBalance(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	strg.EXPECT().LoadBalance(gomock.Any(), "TestUser").Return(money.Amount(50050), money.Points(42), nil).Times(1)
+
+	res, err := cl.Get("http://" + cfg.RunAddress() + "/api/user/balance")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	assert.JSONEq(t, `{"current":500.5,"withdrawn":42}`, string(body))
+}
+
+func TestWithdraw(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantSum  money.Amount
+		err      error
+		wantCode int
+		wantText string
+	}{
+		{
+			name:     "enough points",
+			body:     `{"order":"2377225624","sum":0.3}`,
+			wantSum:  money.Amount(30),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "not enough points",
+			body:     `{"order":"2377225624","sum":0.31}`,
+			wantSum:  money.Amount(31),
+			err:      storageerrs.ErrInsufficientFunds,
+			wantCode: http.StatusPaymentRequired,
+		},
+		{
+			name:     "invalid order",
+			body:     `{"order":"2377225625","sum":1}`,
+			wantCode: http.StatusUnprocessableEntity,
+			wantText: "invalid order number: 2377225625",
+		},
+		{
+			name:     "negative sum",
+			body:     `{"order":"2377225624","sum":-10}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "zero sum",
+			body:     `{"order":"2377225624","sum":0}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "sub-cent sum",
+			body:     `{"order":"2377225624","sum":0.005}`,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "sum as string",
+			body:     `{"order":"2377225624","sum":"1"}`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/balance/withdraw", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			if tt.wantSum != 0 {
+				strg.EXPECT().Withdraw(gomock.Any(), "TestUser", "2377225624", tt.wantSum).Return(tt.err).Times(1)
+			}
+
+			res, err := cl.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			errTxt, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCode, res.StatusCode, string(errTxt))
+			assert.Contains(t, string(errTxt), tt.wantText)
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	body := `{"order":"2377225624","sum":10}`
+	fingerprint := idempotency.Fingerprint(http.MethodPost, "/api/user/balance/withdraw", []byte(body))
+
+	tests := []struct {
+		name       string
+		body       string
+		saved      *idempotency.Record
+		withdraw   error
+		wantCode   int
+		wantReplay bool
+	}{
+		{
+			name:     "first request",
+			body:     body,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:       "replay",
+			body:       body,
+			saved:      &idempotency.Record{Fingerprint: fingerprint, Completed: true, Status: http.StatusOK},
+			wantCode:   http.StatusOK,
+			wantReplay: true,
+		},
+		{
+			name:       "replay of rejected request",
+			body:       body,
+			saved:      &idempotency.Record{Fingerprint: fingerprint, Completed: true, Status: http.StatusPaymentRequired, Body: []byte("not enough coins\n")},
+			wantCode:   http.StatusPaymentRequired,
+			wantReplay: true,
+		},
+		{
+			name:     "in progress",
+			body:     body,
+			saved:    &idempotency.Record{Fingerprint: fingerprint},
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "different payload",
+			body:     `{"order":"2377225624","sum":20}`,
+			saved:    &idempotency.Record{Fingerprint: fingerprint, Completed: true, Status: http.StatusOK},
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "failed request is released",
+			body:     body,
+			withdraw: fmt.Errorf("connection lost"),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/balance/withdraw", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(idempotency.Header, "key1")
+
+			if tt.saved != nil {
+				strg.EXPECT().ReserveIdempotencyKey(gomock.Any(), "TestUser", "key1", gomock.Any(), cfg.IdempotencyTTL()).Return(*tt.saved, false, nil).Times(1)
+			} else {
+				strg.EXPECT().ReserveIdempotencyKey(gomock.Any(), "TestUser", "key1", fingerprint, cfg.IdempotencyTTL()).Return(idempotency.Record{}, true, nil).Times(1)
+				strg.EXPECT().Withdraw(gomock.Any(), "TestUser", "2377225624", money.Points(10)).Return(tt.withdraw).Times(1)
+
+				if tt.wantCode >= http.StatusInternalServerError {
+					strg.EXPECT().ReleaseIdempotencyKey(gomock.Any(), "TestUser", "key1").Return(nil).Times(1)
 				} else {
-					strg.EXPECT().StoreOrder(gomock.Any(), number, "TestUser").Return(nil).Times(1)
+					strg.EXPECT().CompleteIdempotencyKey(gomock.Any(), "TestUser", "key1", idempotency.Record{
+						Fingerprint: fingerprint,
+						Completed:   true,
+						Status:      tt.wantCode,
+					}).Return(nil).Times(1)
+				}
+			}
+
+			res, err := cl.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			resBody, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCode, res.StatusCode, string(resBody))
+			assert.Equal(t, tt.wantReplay, res.Header.Get("Idempotent-Replayed") == "true")
+
+			if tt.wantReplay {
+				assert.Equal(t, string(tt.saved.Body), string(resBody))
+			}
+		})
+	}
+
+	t.Run("body too large", func(t *testing.T) {
+		large := `{"order":"2377225624","sum":10,"note":"` + strings.Repeat("a", maxIdempotentBodySize) + `"}`
+
+		req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/user/balance/withdraw", strings.NewReader(large))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotency.Header, "key1")
+
+		res, err := cl.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	})
+}
+
+func TestLoadStaleOrders(t *testing.T) {
+	cfg := conf.New(conf.WithEnvVars(map[string]string{"ADMIN_TOKEN": "adminToken"}))
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{
+			name:     "admin",
+			token:    "adminToken",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "wrong token",
+			token:    "userToken",
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+cfg.RunAddress()+"/api/admin/orders/stale", nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			want := `[{"number":"12345678903","customer":"TestUser","uploaded_at":"2022-09-01T00:00:00Z"}]`
+			if tt.wantCode == http.StatusOK {
+				strg.EXPECT().LoadStaleOrders(gomock.Any()).
+					Return([]orders.StaleOrder{{Number: "12345678903", Customer: "TestUser", UploadedAt: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)}}, nil).Times(1)
+			}
+
+			res, err := cl.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCode, res.StatusCode, string(body))
+
+			if tt.wantCode == http.StatusOK {
+				assert.JSONEq(t, want, string(body))
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cfg := conf.New(conf.WithEnvVars(map[string]string{"ADMIN_TOKEN": "adminToken"}))
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	strg.EXPECT().RejectedTransitions().Return(uint64(2))
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+cfg.RunAddress()+"/api/admin/status", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer adminToken")
+
+	res, err := cl.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	status := serviceStatus{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.Equal(t, accrual.StateClosed, status.Accrual.State)
+	assert.Equal(t, leader.RoleLeader, status.Leader.Role)
+	assert.Equal(t, uint64(2), status.RejectedTransitions)
+}
+
+func TestJWKS(t *testing.T) {
+	cfg := conf.New()
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	key, err := session.ParseKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+
+	keys, err := session.NewKeyRing("ed", key, session.HMACKey("hmac", []byte("secret")))
+	require.NoError(t, err)
+
+	// New test server
+	ts := newTestSrv(cfg, strg, WithKeyRing(keys))
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	res, err := cl.Get("http://" + cfg.RunAddress() + "/.well-known/jwks.json")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	set := session.JWKS{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&set))
+	require.Len(t, set.Keys, 1, "HMAC keys must not be published")
+	assert.Equal(t, "ed", set.Keys[0].Kid)
+	assert.Equal(t, "EdDSA", set.Keys[0].Alg)
+}
+
+func TestAccrualEvent(t *testing.T) {
+	cfg := conf.New(conf.WithEnvVars(map[string]string{"ACCRUAL_WEBHOOK_SECRET": "webhookSecret"}))
+	ctrl := gomock.NewController(t)
+	strg := newMockStorage(ctrl)
+
+	// New test server
+	ts := newTestSrv(cfg, strg)
+	defer ts.Close()
+	cl := newTestClient(ts)
+
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		fresh     bool
+		wantCode  int
+	}{
+		{
+			name:      "processed",
+			body:      `{"order":"12345678903","status":"PROCESSED","accrual":500}`,
+			signature: sign("webhookSecret", `{"order":"12345678903","status":"PROCESSED","accrual":500}`),
+			fresh:     true,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "processing",
+			body:      `{"order":"12345678903","status":"PROCESSING"}`,
+			signature: sign("webhookSecret", `{"order":"12345678903","status":"PROCESSING"}`),
+			fresh:     true,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "duplicate",
+			body:      `{"order":"12345678903","status":"PROCESSED","accrual":500}`,
+			signature: sign("webhookSecret", `{"order":"12345678903","status":"PROCESSED","accrual":500}`),
+			fresh:     false,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:      "wrong signature",
+			body:      `{"order":"12345678903","status":"PROCESSED","accrual":500}`,
+			signature: sign("otherSecret", `{"order":"12345678903","status":"PROCESSED","accrual":500}`),
+			wantCode:  http.StatusUnauthorized,
+		},
+		{
+			name:      "internal status",
+			body:      `{"order":"12345678903","status":"STALE"}`,
+			signature: sign("webhookSecret", `{"order":"12345678903","status":"STALE"}`),
+			wantCode:  http.StatusBadRequest,
+		},
+		{
+			name:      "new status",
+			body:      `{"order":"12345678903","status":"NEW"}`,
+			signature: sign("webhookSecret", `{"order":"12345678903","status":"NEW"}`),
+			wantCode:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+cfg.RunAddress()+"/api/internal/accrual/events", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("X-Event-ID", "event-"+tt.name)
+			req.Header.Set("X-Signature", tt.signature)
+
+			if tt.wantCode == http.StatusOK {
+				strg.EXPECT().RegisterEvent(gomock.Any(), "event-"+tt.name).Return(tt.fresh, nil).Times(1)
+
+				if tt.fresh {
+					status := orders.Status{}
+					require.NoError(t, json.Unmarshal([]byte(tt.body), &status))
+
+					strg.EXPECT().UpdateStatuses(gomock.Any(), []orders.Status{status}).Return(nil).Times(1)
+
+					if !orders.IsFinal(status.Status) {
+						strg.EXPECT().PostponePolling(gomock.Any(), status.Order, gomock.Any()).Return(nil).Times(1)
+					}
 				}
 			}
 
@@ -249,8 +1219,16 @@ func newTestClient(ts *httptest.Server) *http.Client {
 	return cl
 }
 
-func newTestSrv(cfg *conf.Config, strg *mocks.MockStorage) *httptest.Server {
-	s := New(strg, cfg)
+// newMockStorage returns a storage mock expecting revoked sessions to be loaded on the server start
+func newMockStorage(ctrl *gomock.Controller) *mocks.MockStorage {
+	strg := mocks.NewMockStorage(ctrl)
+	strg.EXPECT().RevokedSessions(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+	return strg
+}
+
+func newTestSrv(cfg *conf.Config, strg *mocks.MockStorage, opts ...serverOption) *httptest.Server {
+	s := New(strg, accrual.New(cfg.AccrualSysAddr()), leader.NewStandalone(), cfg, opts...)
 	r := newRouter(s)
 
 	l, err := net.Listen("tcp", cfg.RunAddress())
@@ -274,26 +1252,45 @@ func newRouter(srv Server) http.Handler {
 
 // POST /api/user/register — регистрация пользователя;
 // POST /api/user/login — аутентификация пользователя;
+// POST /api/user/token/refresh — обмен refresh-токена на новую пару токенов сессии;
+// POST /api/user/logout — завершение текущей сессии пользователя;
+// GET /api/user/sessions — получение списка активных сессий пользователя;
+// DELETE /api/user/sessions/{id} — завершение сессии пользователя или всех его сессий, кроме текущей (id = others);
 // POST /api/user/orders — загрузка пользователем номера заказа для расчёта;
 // GET /api/user/orders — получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях;
+// GET /api/user/orders/{number} — получение заказа пользователя с историей смены его статусов;
 // GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
 // POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
 // GET /api/user/balance/withdrawals — получение информации о выводе средств с накопительного счёта пользователем.
+// POST /api/internal/accrual/events — приём подписанных уведомлений о смене статуса заказа от системы начислений.
+// GET /api/admin/orders/stale — получение списка заказов, не обработанных системой начислений за отведённое время.
+// GET /api/admin/status — получение состояния фоновых процессов.
+// GET /.well-known/jwks.json — публичные ключи для проверки токенов сессий.
 func defaultRoute(srv Server) func(r chi.Router) {
 	return func(r chi.Router) {
 		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/register", http.HandlerFunc(srv.Register))
 		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/login", http.HandlerFunc(srv.Login))
-		r.With(authMock).Method(http.MethodPost, "/api/user/orders", http.HandlerFunc(srv.StoreOrder))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/orders", http.HandlerFunc(srv.LoadOrders))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/balance", http.HandlerFunc(srv.LoadBalance))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodPost, "/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
-		r.With(srv.GzipMW, srv.AuthorisationMW).Method(http.MethodGet, "/api/user/balance/withdrawals", http.HandlerFunc(srv.LoadWithdrawals))
+		r.With(srv.GzipMW).Method(http.MethodPost, "/api/user/token/refresh", http.HandlerFunc(srv.RefreshToken))
+		r.With(authMock).Method(http.MethodPost, "/api/user/logout", http.HandlerFunc(srv.Logout))
+		r.With(authMock).Method(http.MethodGet, "/api/user/sessions", http.HandlerFunc(srv.LoadSessions))
+		r.With(authMock).Method(http.MethodDelete, "/api/user/sessions/{id}", http.HandlerFunc(srv.RevokeSession))
+		r.With(authMock, srv.IdempotencyMW).Method(http.MethodPost, "/api/user/orders", http.HandlerFunc(srv.StoreOrder))
+		r.With(authMock).Method(http.MethodGet, "/api/user/orders", http.HandlerFunc(srv.LoadOrders))
+		r.With(authMock).Method(http.MethodGet, "/api/user/orders/{number}", http.HandlerFunc(srv.LoadOrder))
+		r.With(authMock).Method(http.MethodGet, "/api/user/balance", http.HandlerFunc(srv.LoadBalance))
+		r.With(authMock, srv.IdempotencyMW).Method(http.MethodPost, "/api/user/balance/withdraw", http.HandlerFunc(srv.Withdraw))
+		r.With(authMock).Method(http.MethodGet, "/api/user/balance/withdrawals", http.HandlerFunc(srv.LoadWithdrawals))
+		r.With(srv.AdminMW).Method(http.MethodGet, "/api/admin/orders/stale", http.HandlerFunc(srv.LoadStaleOrders))
+		r.Method(http.MethodPost, "/api/internal/accrual/events", http.HandlerFunc(srv.AccrualEvent))
+		r.With(srv.AdminMW).Method(http.MethodGet, "/api/admin/status", http.HandlerFunc(srv.Status))
+		r.Method(http.MethodGet, "/.well-known/jwks.json", http.HandlerFunc(srv.JWKS))
 	}
 }
 
 func authMock(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.WithValue(r.Context(), srvCtxKey("userID"), "TestUser")
+		ctx = context.WithValue(ctx, srvCtxKey("sessionID"), "TestSession")
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
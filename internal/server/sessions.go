@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"github.com/usa4ev/gophermart/internal/session"
+	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
+)
+
+const (
+	accessCookie  = "Authorization"
+	refreshCookie = "Refresh"
+	// refreshPath limits the refresh token cookie to the session endpoints
+	refreshPath = "/api/user"
+	// otherSessions is the ID to revoke all sessions but the current one
+	otherSessions = "others"
+)
+
+// openSession starts a new session of the user and sets its access and refresh tokens cookies
+func (srv Server) openSession(w http.ResponseWriter, r *http.Request, userID string) {
+	sessionID := uuid.NewString()
+
+	refresh, hash, err := session.NewRefreshToken(sessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open new session: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	refreshExpiresAt := time.Now().Add(srv.cfg.RefreshTokenLifetime())
+
+	err = srv.strg.CreateSession(r.Context(), userID, sessionID, hash, device(r), refreshExpiresAt)
+	if err != nil {
+		errtxt := fmt.Sprintf("failed to open new session: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	srv.setTokens(w, session.Claims{UserID: userID, SessionID: sessionID}, refresh, refreshExpiresAt)
+}
+
+// device returns the user agent and the IP address of the request
+func device(r *http.Request) session.Device {
+	return session.NewDevice(r.UserAgent(), clientIP(r))
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// setTokens sets cookies with a new access token of the session and its refresh token
+func (srv Server) setTokens(w http.ResponseWriter, claims session.Claims, refresh string, refreshExpiresAt time.Time) {
+	token, expiresAt, err := srv.keys.Open(claims, srv.cfg.SessionLifetime())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open new session: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: accessCookie, Value: token, Expires: expiresAt})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Value: refresh, Path: refreshPath, Expires: refreshExpiresAt, HttpOnly: true})
+}
+
+// RefreshToken handler exchanges the refresh token for a new pair of access and refresh tokens.
+// A refresh token used twice revokes the whole session.
+func (srv Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(refreshCookie)
+	if err != nil {
+		http.Error(w, "refresh token is missing", http.StatusUnauthorized)
+
+		return
+	}
+
+	sessionID, oldHash, err := session.ParseRefreshToken(c.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	refresh, newHash, err := session.NewRefreshToken(sessionID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to refresh session: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	userID, expiresAt, err := srv.strg.RotateRefreshToken(r.Context(), sessionID, oldHash, newHash)
+	if errors.Is(err, storageerrs.ErrTokenReused) {
+		// the token might have been stolen, access tokens of the session must not work either
+		srv.revoked.Add(sessionID)
+		log.Printf("refresh token of session %v is reused, the session is revoked\n", sessionID)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	} else if errors.Is(err, storageerrs.ErrSessionRevoked) || errors.Is(err, storageerrs.ErrNoResults) {
+		http.Error(w, storageerrs.ErrSessionRevoked.Error(), http.StatusUnauthorized)
+
+		return
+	} else if err != nil {
+		errtxt := fmt.Sprintf("failed to refresh session: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	// the session lifetime is not extended by refreshing
+	srv.setTokens(w, session.Claims{UserID: userID, SessionID: sessionID}, refresh, expiresAt)
+}
+
+// Logout handler revokes the current session and removes its cookies
+func (srv Server) Logout(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(srvCtxKey("userID")).(string)
+	sessionID, ok2 := r.Context().Value(srvCtxKey("sessionID")).(string)
+
+	if !ok || !ok2 {
+		errtxt := "request context is missing user or session ID"
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	err := srv.strg.RevokeSession(r.Context(), userID, sessionID)
+	if err != nil && !errors.Is(err, storageerrs.ErrNoResults) {
+		errtxt := fmt.Sprintf("failed to revoke session: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	srv.revoked.Add(sessionID)
+
+	http.SetCookie(w, &http.Cookie{Name: accessCookie, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: refreshPath, MaxAge: -1, HttpOnly: true})
+}
+
+// syncSessions saves last seen times of sessions and loads sessions revoked by other replicas.
+func (srv Server) syncSessions() {
+	ticker := time.NewTicker(srv.cfg.RevocationRefreshInterval())
+
+	for {
+		<-ticker.C
+		srv.saveActivity()
+		srv.loadRevocations()
+	}
+}
+
+func (srv Server) saveActivity() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := srv.strg.TouchSessions(ctx, srv.activity.Flush())
+	if err != nil {
+		log.Printf("failed to save sessions activity: %v\n", err)
+	}
+}
+
+// loadRevocations loads revoked sessions. Sessions revoked earlier than the access token lifetime
+// are not needed as their access tokens are expired.
+func (srv Server) loadRevocations() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	loadedAt := time.Now()
+
+	ids, err := srv.strg.RevokedSessions(ctx, loadedAt.Add(-srv.cfg.SessionLifetime()))
+	if err != nil {
+		log.Printf("failed to load revoked sessions: %v\n", err)
+
+		return
+	}
+
+	srv.revoked.Replace(ids, loadedAt)
+}
+
+// LoadSessions handler returns active sessions of the user
+func (srv Server) LoadSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(srvCtxKey("userID")).(string)
+	sessionID, ok2 := r.Context().Value(srvCtxKey("sessionID")).(string)
+
+	if !ok || !ok2 {
+		errtxt := "request context is missing user or session ID"
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	res, err := srv.strg.LoadSessions(r.Context(), userID)
+	if err != nil {
+		errtxt := fmt.Sprintf("failed to get sessions from database: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	for i := range res {
+		res[i].Current = res[i].ID == sessionID
+	}
+
+	writeList(w, res, len(res))
+}
+
+// RevokeSession handler revokes the session of the user by its ID
+// or all sessions but the current one if the ID is "others"
+func (srv Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(srvCtxKey("userID")).(string)
+	sessionID, ok2 := r.Context().Value(srvCtxKey("sessionID")).(string)
+
+	if !ok || !ok2 {
+		errtxt := "request context is missing user or session ID"
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	if id == otherSessions {
+		revoked, err := srv.strg.RevokeOtherSessions(r.Context(), userID, sessionID)
+		if err != nil {
+			errtxt := fmt.Sprintf("failed to revoke sessions: %v", err)
+			http.Error(w, errtxt, http.StatusInternalServerError)
+			log.Printf(errtxt + "\n")
+
+			return
+		}
+
+		for _, id := range revoked {
+			srv.revoked.Add(id)
+		}
+
+		return
+	}
+
+	err := srv.strg.RevokeSession(r.Context(), userID, id)
+	if errors.Is(err, storageerrs.ErrNoResults) {
+		http.Error(w, "session not found", http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		errtxt := fmt.Sprintf("failed to revoke session: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	}
+
+	srv.revoked.Add(id)
+}
@@ -1,14 +1,17 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/usa4ev/gophermart/internal/auth"
-	"github.com/usa4ev/gophermart/internal/session"
 )
 
 type (
@@ -40,7 +43,7 @@ func (srv Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := auth.RegisterUser(r.Context(), cred.Login, cred.Password, srv.strg)
+	userID, err := auth.RegisterUser(r.Context(), cred.Login, cred.Password, srv.hashParams, srv.strg)
 	if errors.Is(err, auth.ErrUserAlreadyExists) {
 		http.Error(w, err.Error(), http.StatusConflict)
 
@@ -51,17 +54,12 @@ func (srv Server) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, expiresAt, err := session.Open(userID, srv.cfg.SessionLifetime())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to open new session: %v", err), http.StatusInternalServerError)
-
-		return
-	}
-
-	http.SetCookie(w, &http.Cookie{Name: "Authorization", Value: token, Expires: expiresAt})
+	srv.openSession(w, r, userID)
 }
 
-// Register handler adds a new user if one does not exist and opens a new session
+// Login handler checks the user's password and opens a new session.
+// Attempts throttled after failed logins of the user or the client IP are answered
+// with 429 and Retry-After without checking the password.
 func (srv Server) Login(w http.ResponseWriter, r *http.Request) {
 	ct := r.Header.Get("Content-Type")
 	if ct != "" && ct != ctJSON {
@@ -82,9 +80,30 @@ func (srv Server) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := auth.Login(r.Context(), cred.Login, cred.Password, srv.strg)
+	ip := clientIP(r)
+
+	// checked before the password as every check costs an Argon2 computation
+	wait, err := srv.limiter.Allow(r.Context(), cred.Login, ip)
+	if err != nil {
+		errtxt := fmt.Sprintf("authentication failed: %v", err)
+		http.Error(w, errtxt, http.StatusInternalServerError)
+		log.Printf(errtxt + "\n")
+
+		return
+	} else if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many failed login attempts", http.StatusTooManyRequests)
+
+		return
+	}
+
+	userID, err := auth.Login(r.Context(), cred.Login, cred.Password, srv.hashParams, srv.strg)
 
 	if errors.Is(err, auth.ErrUnathorized) {
+		if err := srv.limiter.Failed(r.Context(), cred.Login, ip); err != nil {
+			log.Printf("%v\n", err)
+		}
+
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 
 		return
@@ -94,20 +113,16 @@ func (srv Server) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, expiresAt, err := session.Open(userID, srv.cfg.SessionLifetime())
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to open new session: %v", err), http.StatusInternalServerError)
-
-		return
+	if err := srv.limiter.Succeeded(r.Context(), cred.Login); err != nil {
+		log.Printf("%v\n", err)
 	}
 
-	http.SetCookie(w, &http.Cookie{Name: "Authorization", Value: token, Expires: expiresAt})
+	srv.openSession(w, r, userID)
 }
 
 func (srv Server) AuthorisationMW(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("Authorization")
+		c, err := r.Cookie(accessCookie)
 		if err != nil {
 			if err == http.ErrNoCookie {
 				w.WriteHeader(http.StatusUnauthorized)
@@ -122,15 +137,34 @@ func (srv Server) AuthorisationMW(next http.Handler) http.Handler {
 
 		tokenString := c.Value
 
-		userID, err := session.Verify(tokenString)
+		claims, err := srv.keys.Verify(tokenString)
 
-		if err != nil {
+		if err != nil || srv.revoked.Revoked(claims.SessionID) {
 			w.WriteHeader(http.StatusUnauthorized)
 
 			return
 		}
 
-		ctx := context.WithValue(context.Background(), srvCtxKey("userID"), userID)
+		srv.activity.Seen(claims.SessionID)
+
+		ctx := context.WithValue(context.Background(), srvCtxKey("userID"), claims.UserID)
+		ctx = context.WithValue(ctx, srvCtxKey("sessionID"), claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// JWKS handler publishes public keys verifying session tokens
+func (srv Server) JWKS(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+
+	if err := enc.Encode(srv.keys.JWKS()); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode answer: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-Type", ctJSON)
+
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUserAgent is the longest user agent kept, the rest is cut off
+const maxUserAgent = 512
+
+type (
+	// Device describes where the session is opened from
+	Device struct {
+		UserAgent string
+		IP        string
+	}
+
+	// Session is an active session of the user
+	Session struct {
+		ID         string    `json:"id"`
+		UserAgent  string    `json:"user_agent"`
+		IP         string    `json:"ip"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastSeenAt time.Time `json:"last_seen_at"`
+		// Current is true for the session of the request
+		Current bool `json:"current"`
+	}
+
+	// Activity collects last seen times of sessions in memory
+	// so they are saved in batches rather than on every request
+	Activity struct {
+		mu   sync.Mutex
+		seen map[string]time.Time
+	}
+)
+
+// NewDevice returns the device truncating the user agent to fit the storage
+func NewDevice(userAgent, ip string) Device {
+	if len(userAgent) > maxUserAgent {
+		// a rune cut in half is dropped
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgent], "")
+	}
+
+	return Device{UserAgent: userAgent, IP: ip}
+}
+
+func NewActivity() *Activity {
+	return &Activity{seen: make(map[string]time.Time)}
+}
+
+// Seen records the session is used now
+func (a *Activity) Seen(sessionID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seen[sessionID] = time.Now()
+}
+
+// Flush returns the sessions seen since the previous flush
+func (a *Activity) Flush() map[string]time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seen := a.seen
+	a.seen = make(map[string]time.Time, len(seen))
+
+	return seen
+}
@@ -0,0 +1,33 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDevice(t *testing.T) {
+	d := NewDevice("curl/7.85.0", "10.0.0.1")
+	assert.Equal(t, Device{UserAgent: "curl/7.85.0", IP: "10.0.0.1"}, d)
+
+	// a two-byte rune crosses the limit
+	d = NewDevice("a"+strings.Repeat("я", maxUserAgent), "10.0.0.1")
+	assert.True(t, utf8.ValidString(d.UserAgent))
+	assert.Len(t, d.UserAgent, maxUserAgent-1)
+}
+
+func TestActivity(t *testing.T) {
+	a := NewActivity()
+
+	a.Seen("session1")
+	a.Seen("session2")
+	a.Seen("session1")
+
+	seen := a.Flush()
+	assert.Len(t, seen, 2)
+	assert.Contains(t, seen, "session1")
+
+	assert.Empty(t, a.Flush())
+}
@@ -0,0 +1,203 @@
+package session
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SecretKeyID is the ID of the HMAC key given as a secret string rather than a file
+const SecretKeyID = "default"
+
+type (
+	// Key is a key signing and verifying tokens with the ID put to the kid header.
+	// A key parsed from a public key only verifies tokens.
+	Key struct {
+		ID        string
+		Method    jwt.SigningMethod
+		signKey   interface{}
+		verifyKey interface{}
+	}
+
+	// KeyRing signs new tokens with the active key and verifies tokens with any of its keys,
+	// so old keys keep working until they are removed from the ring.
+	KeyRing struct {
+		active string
+		keys   map[string]Key
+		order  []string
+	}
+
+	// JWK is a public key in the JSON Web Key format
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+	}
+
+	// JWKS is a set of public keys
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+)
+
+// HMACKey returns a HS256 key
+func HMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// ParseKey parses a PEM encoded RSA (RS256) or Ed25519 (EdDSA) private or public key.
+// Anything else is used as a HMAC (HS256) secret.
+func ParseKey(id string, data []byte) (Key, error) {
+	if !strings.Contains(string(data), "-----BEGIN") {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) == 0 {
+			return Key{}, fmt.Errorf("key %v is empty", id)
+		}
+
+		return HMACKey(id, secret), nil
+	}
+
+	if k, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return Key{ID: id, Method: jwt.SigningMethodRS256, signKey: k, verifyKey: &k.PublicKey}, nil
+	}
+
+	if k, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return Key{ID: id, Method: jwt.SigningMethodRS256, verifyKey: k}, nil
+	}
+
+	if k, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		if k, ok := k.(ed25519.PrivateKey); ok {
+			return Key{ID: id, Method: jwt.SigningMethodEdDSA, signKey: k, verifyKey: k.Public()}, nil
+		}
+	}
+
+	if k, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		if k, ok := k.(ed25519.PublicKey); ok {
+			return Key{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: k}, nil
+		}
+	}
+
+	return Key{}, fmt.Errorf("key %v is neither RSA nor Ed25519 key", id)
+}
+
+// NewKeyRing returns a KeyRing signing tokens with the key with the active ID
+func NewKeyRing(active string, keys ...Key) (*KeyRing, error) {
+	ring := &KeyRing{active: active, keys: make(map[string]Key, len(keys))}
+
+	for _, k := range keys {
+		if _, ok := ring.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %v", k.ID)
+		}
+
+		ring.keys[k.ID] = k
+		ring.order = append(ring.order, k.ID)
+	}
+
+	k, ok := ring.keys[active]
+	if !ok {
+		return nil, fmt.Errorf("active key %v is not in the key ring", active)
+	}
+
+	if k.signKey == nil {
+		return nil, fmt.Errorf("active key %v cannot sign tokens", active)
+	}
+
+	return ring, nil
+}
+
+// LoadKeyRing builds a KeyRing from the HMAC secret and comma separated "id=path" key files.
+// The first key signs tokens unless the active key ID is given.
+func LoadKeyRing(secret, files, active string) (*KeyRing, error) {
+	var keys []Key
+
+	for _, v := range strings.Split(files, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		id, path, found := strings.Cut(v, "=")
+		if !found || id == "" || path == "" {
+			return nil, fmt.Errorf("invalid key file %q, expected id=path", v)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %v: %w", id, err)
+		}
+
+		k, err := ParseKey(id, data)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	if secret != "" {
+		keys = append(keys, HMACKey(SecretKeyID, []byte(secret)))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys configured")
+	}
+
+	if active == "" {
+		active = keys[0].ID
+	}
+
+	return NewKeyRing(active, keys...)
+}
+
+// NewEphemeralKeyRing returns a KeyRing with a random HMAC key.
+// Its tokens are not valid after a restart or on other replicas.
+func NewEphemeralKeyRing() *KeyRing {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate signing key: %v", err))
+	}
+
+	ring, _ := NewKeyRing("ephemeral", HMACKey("ephemeral", secret))
+
+	return ring
+}
+
+// JWKS returns public keys of the ring, HMAC keys are secret and not published
+func (r *KeyRing) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+
+	for _, id := range r.order {
+		k := r.keys[id]
+		jwk := JWK{Kid: k.ID, Alg: k.Method.Alg(), Use: "sig"}
+
+		switch pub := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
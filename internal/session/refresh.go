@@ -0,0 +1,95 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revocations is a concurrency-safe in-memory list of revoked sessions
+// checked on every request instead of the storage
+type Revocations struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time // when the session was added to the list
+}
+
+// NewRefreshToken returns a new random refresh token of the session and its hash to store.
+// The token itself is never stored.
+func NewRefreshToken(sessionID string) (string, string, error) {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	token := sessionID + "." + base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, HashToken(token), nil
+}
+
+// ParseRefreshToken returns the session ID and the hash of the refresh token
+func ParseRefreshToken(token string) (string, string, error) {
+	sessionID, secret, found := strings.Cut(token, ".")
+	if !found || sessionID == "" || secret == "" {
+		return "", "", fmt.Errorf("malformed refresh token")
+	}
+
+	return sessionID, HashToken(token), nil
+}
+
+// HashToken returns hex encoded sha256 of the token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func NewRevocations() *Revocations {
+	return &Revocations{revoked: make(map[string]time.Time)}
+}
+
+// Revoked returns true if the session is revoked
+func (r *Revocations) Revoked(sessionID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.revoked[sessionID]
+
+	return ok
+}
+
+// Add adds the session revoked by this replica to the list right away
+func (r *Revocations) Add(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revoked[sessionID] = time.Now()
+}
+
+// Replace replaces the list with sessions loaded from the storage.
+// Sessions added after the load started are kept as they might be missing from the result.
+func (r *Revocations) Replace(sessionIDs []string, loadedAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	revoked := make(map[string]time.Time, len(sessionIDs))
+
+	for id, at := range r.revoked {
+		if at.After(loadedAt) {
+			revoked[id] = at
+		}
+	}
+
+	for _, id := range sessionIDs {
+		if _, ok := revoked[id]; !ok {
+			revoked[id] = loadedAt
+		}
+	}
+
+	r.revoked = revoked
+}
@@ -0,0 +1,46 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshToken(t *testing.T) {
+	token, hash, err := NewRefreshToken("session1")
+	require.NoError(t, err)
+
+	other, otherHash, err := NewRefreshToken("session1")
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+	assert.NotEqual(t, hash, otherHash)
+
+	sessionID, parsedHash, err := ParseRefreshToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "session1", sessionID)
+	assert.Equal(t, hash, parsedHash)
+
+	for _, s := range []string{"", "session1", ".secret", "session1."} {
+		_, _, err := ParseRefreshToken(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	r := NewRevocations()
+	assert.False(t, r.Revoked("session1"))
+
+	r.Add("session1")
+	assert.True(t, r.Revoked("session1"))
+
+	// revoked by another replica
+	loadedAt := time.Now()
+	r.Add("session2")
+	r.Replace([]string{"session3"}, loadedAt)
+
+	assert.False(t, r.Revoked("session1"), "added before the load and missing from it")
+	assert.True(t, r.Revoked("session2"), "added during the load")
+	assert.True(t, r.Revoked("session3"))
+}
@@ -7,45 +7,64 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-const secret = "KLjkjd34vnsiullJK23490"
+// Claims identify the user and the session an access token is issued for
+type Claims struct {
+	UserID    string
+	SessionID string
+}
 
-// Verify returns userID and nil as an error if passed token is valid
+// Verify returns claims of the token and nil as an error if passed token is valid
 // and error if invalid
-func Verify(signedString string) (string, error) {
+func (r *KeyRing) Verify(signedString string) (Claims, error) {
 	token, err := jwt.Parse(signedString, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+
+		k, ok := r.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		// the alg header must match the key, otherwise e.g. a public key could be used as a HMAC secret
+		if token.Method.Alg() != k.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(secret), nil
+		return k.verifyKey, nil
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("token is not valid: %w", err)
+		return Claims{}, fmt.Errorf("token is not valid: %w", err)
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		return claims["userID"].(string), nil
+		userID, _ := claims["userID"].(string)
+		sessionID, _ := claims["sid"].(string)
+
+		if userID != "" && sessionID != "" {
+			return Claims{UserID: userID, SessionID: sessionID}, nil
+		}
 	}
 
-	return "", fmt.Errorf("token does not contain user id")
+	return Claims{}, fmt.Errorf("token does not contain user or session id")
 }
 
-// Open opens new session and returns
-// a signed JWT string with expiration date and UserID
-func Open(userID string, lifeTime time.Duration) (string, time.Time, error) {
+// Open returns an access token of the session, i.e.
+// a signed JWT string with expiration date, UserID and session ID signed with the active key
+func (r *KeyRing) Open(c Claims, lifeTime time.Duration) (string, time.Time, error) {
 	expiresAt := time.Now().Add(lifeTime)
 
 	claims := jwt.MapClaims{
-		"userID": userID,
+		"userID": c.UserID,
+		"sid":    c.SessionID,
 		"exp":    expiresAt.Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	k := r.keys[r.active]
+
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.ID
 
-	signedString, err := token.SignedString([]byte(secret))
+	signedString, err := token.SignedString(k.signKey)
 
 	return signedString, expiresAt, err
 }
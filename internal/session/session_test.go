@@ -1,9 +1,18 @@
 package session
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -15,34 +24,147 @@ func TestOpenVerify(t *testing.T) {
 	}
 
 	tt := args{userID: "user1", lifeTime: 5 * time.Second}
+	ring := NewEphemeralKeyRing()
 
 	t.Run("open/close no error", func(t *testing.T) {
-		got, _, err := Open(tt.userID, tt.lifeTime)
+		got, _, err := ring.Open(Claims{UserID: tt.userID, SessionID: "session1"}, tt.lifeTime)
 		require.NoError(t, err)
 
-		userID, err := Verify(got)
+		claims, err := ring.Verify(got)
 		require.NoError(t, err)
-		assert.Equal(t, tt.userID, userID)
+		assert.Equal(t, tt.userID, claims.UserID)
+		assert.Equal(t, "session1", claims.SessionID)
 	})
 
 	t.Run("invalid token", func(t *testing.T) {
-		_, err := Verify("not a token")
+		_, err := ring.Verify("not a token")
 		if err == nil {
 			t.Errorf("invalid token passed validation")
 		}
 	})
 
 	t.Run("expired token", func(t *testing.T) {
-		got, _, err := Open(tt.userID, tt.lifeTime)
+		got, _, err := ring.Open(Claims{UserID: tt.userID, SessionID: "session1"}, tt.lifeTime)
 		require.NoError(t, err)
 
 		timer := time.NewTimer(6 * time.Second)
 
 		<-timer.C
 
-		_, err = Verify(got)
+		_, err = ring.Verify(got)
 		if err == nil {
 			t.Errorf("expired token passed validation")
 		}
 	})
 }
+
+func writeKey(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	return path
+}
+
+func TestKeyRing(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	rsaPath := writeKey(t, dir, "rsa.pem", rsaKey)
+	edPath := writeKey(t, dir, "ed.pem", edKey)
+
+	old, err := LoadKeyRing("old secret", "", "")
+	require.NoError(t, err)
+
+	oldToken, _, err := old.Open(Claims{UserID: "user1", SessionID: "session1"}, time.Minute)
+	require.NoError(t, err)
+
+	for _, active := range []string{"rsa", "ed", SecretKeyID} {
+		t.Run(active, func(t *testing.T) {
+			ring, err := LoadKeyRing("old secret", "rsa="+rsaPath+", ed="+edPath, active)
+			require.NoError(t, err)
+
+			token, _, err := ring.Open(Claims{UserID: "user1", SessionID: "session1"}, time.Minute)
+			require.NoError(t, err)
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			require.NoError(t, err)
+			assert.Equal(t, active, parsed.Header["kid"])
+
+			claims, err := ring.Verify(token)
+			require.NoError(t, err)
+			assert.Equal(t, "user1", claims.UserID)
+
+			// tokens of the rotated key are still valid
+			claims, err = ring.Verify(oldToken)
+			require.NoError(t, err)
+			assert.Equal(t, "user1", claims.UserID)
+		})
+	}
+
+	// the old key is retired
+	ring, err := LoadKeyRing("", "rsa="+rsaPath, "")
+	require.NoError(t, err)
+
+	_, err = ring.Verify(oldToken)
+	assert.Error(t, err)
+
+	// the public key must not be accepted as a HMAC secret
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userID": "user1", "sid": "session1", "exp": time.Now().Add(time.Minute).Unix()})
+	forged.Header["kid"] = "rsa"
+	forgedToken, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	require.NoError(t, err)
+
+	_, err = ring.Verify(forgedToken)
+	assert.Error(t, err)
+
+	_, err = LoadKeyRing("", "", "")
+	assert.Error(t, err)
+
+	_, err = LoadKeyRing("secret", "", "missing")
+	assert.Error(t, err)
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(edPub)
+	require.NoError(t, err)
+
+	edKey, err := ParseKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+
+	ring, err := NewKeyRing("rsa",
+		Key{ID: "rsa", Method: jwt.SigningMethodRS256, signKey: rsaKey, verifyKey: &rsaKey.PublicKey},
+		edKey,
+		HMACKey("hmac", []byte("secret")))
+	require.NoError(t, err)
+
+	set := ring.JWKS()
+	require.Len(t, set.Keys, 2)
+
+	assert.Equal(t, "RSA", set.Keys[0].Kty)
+	assert.Equal(t, "RS256", set.Keys[0].Alg)
+	assert.Equal(t, "AQAB", set.Keys[0].E)
+	assert.Equal(t, "OKP", set.Keys[1].Kty)
+	assert.Equal(t, "EdDSA", set.Keys[1].Alg)
+	assert.Equal(t, "Ed25519", set.Keys[1].Crv)
+
+	// keys without a private part cannot be active
+	_, err = NewKeyRing("ed", edKey)
+	assert.Error(t, err)
+}
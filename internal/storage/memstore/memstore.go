@@ -0,0 +1,792 @@
+// Package memstore keeps the service data in memory. It implements the same storage
+// methods as the Postgres storage and is meant for running the service locally and for tests.
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/usa4ev/gophermart/internal/auth"
+	"github.com/usa4ev/gophermart/internal/idempotency"
+	"github.com/usa4ev/gophermart/internal/ledger"
+	"github.com/usa4ev/gophermart/internal/money"
+	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/session"
+	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
+)
+
+type (
+	// Store is a concurrency-safe in-memory storage
+	Store struct {
+		mu sync.Mutex
+
+		users       map[string]user   // by ID
+		usernames   map[string]string // user IDs by username
+		orders      map[string]*order
+		withdrawals map[string]withdrawal
+		jobs        map[string]*job
+		history     map[string][]orders.Transition
+		events      map[string]time.Time // receive times by event ID
+		entries     []ledger.Entry
+		posted      map[entryKey]struct{}
+		keys        map[idempotencyKey]idempotencyRecord
+		statuses    *orders.StatusMachine
+		sessions    map[string]*userSession
+		attempts    map[string]auth.Attempts
+	}
+
+	userSession struct {
+		customer    string
+		refreshHash string
+		device      session.Device
+		createdAt   time.Time
+		lastSeenAt  time.Time
+		expiresAt   time.Time
+		revokedAt   time.Time
+	}
+
+	user struct {
+		id       string
+		username string
+		hash     string
+	}
+
+	order struct {
+		number     string
+		customer   string
+		status     string
+		accrual    money.Amount
+		uploadedAt time.Time
+	}
+
+	withdrawal struct {
+		number      string
+		customer    string
+		sum         money.Amount
+		processedAt time.Time
+	}
+
+	job struct {
+		attempts    int
+		nextAttempt time.Time
+		leaseOwner  string
+		leaseUntil  time.Time
+	}
+
+	entryKey struct {
+		account, kind, reference string
+	}
+
+	idempotencyKey struct {
+		userID, key string
+	}
+
+	idempotencyRecord struct {
+		idempotency.Record
+		createdAt time.Time
+	}
+)
+
+// New returns an empty Store
+func New() *Store {
+	return &Store{
+		users:       make(map[string]user),
+		usernames:   make(map[string]string),
+		orders:      make(map[string]*order),
+		withdrawals: make(map[string]withdrawal),
+		jobs:        make(map[string]*job),
+		history:     make(map[string][]orders.Transition),
+		events:      make(map[string]time.Time),
+		posted:      make(map[entryKey]struct{}),
+		keys:        make(map[idempotencyKey]idempotencyRecord),
+		statuses:    orders.NewStatusMachine(),
+		sessions:    make(map[string]*userSession),
+		attempts:    make(map[string]auth.Attempts),
+	}
+}
+
+// AddUser adds new user and returns its ID
+func (s *Store) AddUser(ctx context.Context, username, hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.usernames[username]; ok {
+		return "", auth.ErrUserAlreadyExists
+	}
+
+	id := uuid.New().String()
+	s.users[id] = user{id: id, username: username, hash: hash}
+	s.usernames[username] = id
+
+	return id, nil
+}
+
+// UserExists returns true if user found by given userName
+func (s *Store) UserExists(ctx context.Context, userName string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.usernames[userName]
+
+	return ok, nil
+}
+
+// GetPasswordHash returns user ID and pwd hash found by given userName or empty string as user ID if user not found
+func (s *Store) GetPasswordHash(ctx context.Context, userName string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.usernames[userName]
+	if !ok {
+		return "", "", nil
+	}
+
+	return id, s.users[id].hash, nil
+}
+
+// UpdatePasswordHash replaces the password hash of the user
+func (s *Store) UpdatePasswordHash(ctx context.Context, userID, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return storageerrs.ErrNoResults
+	}
+
+	u.hash = hash
+	s.users[userID] = u
+
+	return nil
+}
+
+// StoreOrder adds new order and puts it in the accrual polling queue to be polled from pollAt
+func (s *Store) StoreOrder(ctx context.Context, orderNum, userID string, pollAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if o, ok := s.orders[orderNum]; ok {
+		if o.customer == userID {
+			return storageerrs.ErrOrderLoaded
+		}
+
+		return storageerrs.ErrOrderExists
+	}
+
+	now := time.Now()
+
+	s.orders[orderNum] = &order{number: orderNum, customer: userID, status: orders.StatusNew, uploadedAt: now}
+	s.jobs[orderNum] = &job{nextAttempt: pollAt}
+	s.history[orderNum] = []orders.Transition{{Status: orders.StatusNew, At: now}}
+
+	return nil
+}
+
+// LoadOrders returns a page of the user's orders ordered by upload time
+func (s *Store) LoadOrders(ctx context.Context, userID string, filter orders.Filter) ([]orders.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orderBatch := make([]orders.Order, 0)
+
+	for _, o := range s.orders {
+		if o.customer == userID && filter.Match(o.uploadedAt, o.number, o.status) {
+			orderBatch = append(orderBatch, orders.Order{Number: o.number, Status: o.status, Accrual: o.accrual, UploadedAt: o.uploadedAt})
+		}
+	}
+
+	sort.Slice(orderBatch, func(i, j int) bool {
+		a, b := orderBatch[i], orderBatch[j]
+		if filter.Desc {
+			a, b = b, a
+		}
+
+		return orders.Less(a.UploadedAt, a.Number, b.UploadedAt, b.Number)
+	})
+
+	if filter.Limit > 0 && len(orderBatch) > filter.Limit {
+		orderBatch = orderBatch[:filter.Limit]
+	}
+
+	return orderBatch, nil
+}
+
+// LoadOrder returns the user's order with its status history
+// or ErrNoResults if the user has no such order
+func (s *Store) LoadOrder(ctx context.Context, userID, number string) (orders.Details, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[number]
+	if !ok || o.customer != userID {
+		return orders.Details{}, storageerrs.ErrNoResults
+	}
+
+	return orders.Details{
+		Order:   orders.Order{Number: o.number, Status: o.status, Accrual: o.accrual, UploadedAt: o.uploadedAt},
+		History: append([]orders.Transition(nil), s.history[number]...),
+	}, nil
+}
+
+// LoadBalance returns the current balance of the user and the total withdrawn derived from the ledger
+func (s *Store) LoadBalance(ctx context.Context, userID string) (money.Amount, money.Amount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total, withdrawn := ledger.Balance(s.entries, userID)
+
+	return total, withdrawn, nil
+}
+
+// Withdraw stores the withdrawal and posts it to the ledger
+// or returns ErrInsufficientFunds if the balance is less than the sum
+func (s *Store) Withdraw(ctx context.Context, userID, number string, sum money.Amount) error {
+	if sum <= 0 {
+		return storageerrs.ErrInvalidSum
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if total, _ := ledger.Balance(s.entries, userID); total < sum {
+		return storageerrs.ErrInsufficientFunds
+	}
+
+	if _, ok := s.withdrawals[number]; ok {
+		return fmt.Errorf("withdrawal for order %v already exists", number)
+	}
+
+	now := time.Now()
+
+	s.withdrawals[number] = withdrawal{number: number, customer: userID, sum: sum, processedAt: now}
+	s.post(ledger.Withdrawal(userID, number, sum, now))
+
+	return nil
+}
+
+// LoadWithdrawals returns a page of the user's withdrawals ordered by processing time
+func (s *Store) LoadWithdrawals(ctx context.Context, userID string, filter orders.Filter) ([]orders.Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	withdrawals := make([]orders.Withdrawal, 0)
+
+	filter.Statuses = nil // withdrawals have no statuses
+
+	for _, w := range s.withdrawals {
+		if w.customer == userID && filter.Match(w.processedAt, w.number, "") {
+			withdrawals = append(withdrawals, orders.Withdrawal{Order: w.number, Sum: w.sum, ProcessedAt: w.processedAt})
+		}
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		a, b := withdrawals[i], withdrawals[j]
+		if filter.Desc {
+			a, b = b, a
+		}
+
+		return orders.Less(a.ProcessedAt, a.Order, b.ProcessedAt, b.Order)
+	})
+
+	if filter.Limit > 0 && len(withdrawals) > filter.Limit {
+		withdrawals = withdrawals[:filter.Limit]
+	}
+
+	return withdrawals, nil
+}
+
+// OrdersToProcess leases up to limit orders due to be polled for the given time.
+// Orders leased by other owners are skipped until their leases expire.
+func (s *Store) OrdersToProcess(ctx context.Context, owner string, limit int, lease time.Duration) ([]orders.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	due := make([]string, 0)
+
+	for number, j := range s.jobs {
+		if !j.nextAttempt.After(now) && (j.leaseOwner == "" || j.leaseUntil.Before(now)) {
+			due = append(due, number)
+		}
+	}
+
+	sort.Slice(due, func(i, k int) bool {
+		return s.jobs[due[i]].nextAttempt.Before(s.jobs[due[k]].nextAttempt)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := make([]orders.Job, 0, len(due))
+
+	for _, number := range due {
+		j := s.jobs[number]
+		j.leaseOwner = owner
+		j.leaseUntil = now.Add(lease)
+
+		o := s.orders[number]
+		jobs = append(jobs, orders.Job{Number: number, Status: o.status, Attempts: j.attempts, UploadedAt: o.uploadedAt})
+	}
+
+	return jobs, nil
+}
+
+// LoadStaleOrders returns orders the accrual system failed to process in time
+func (s *Store) LoadStaleOrders(ctx context.Context) ([]orders.StaleOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orderBatch := make([]orders.StaleOrder, 0)
+
+	for _, o := range s.orders {
+		if o.status == orders.StatusStale {
+			orderBatch = append(orderBatch, orders.StaleOrder{Number: o.number, Customer: o.customer, UploadedAt: o.uploadedAt})
+		}
+	}
+
+	sort.Slice(orderBatch, func(i, j int) bool {
+		return orderBatch[i].UploadedAt.Before(orderBatch[j].UploadedAt)
+	})
+
+	return orderBatch, nil
+}
+
+// RescheduleOrders releases orders leased by the owner and sets the time they are to be polled again
+func (s *Store) RescheduleOrders(ctx context.Context, owner string, next map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for number, ts := range next {
+		j, ok := s.jobs[number]
+		if !ok || j.leaseOwner != owner {
+			continue
+		}
+
+		j.attempts++
+		j.nextAttempt = ts
+		j.leaseOwner = ""
+		j.leaseUntil = time.Time{}
+	}
+
+	return nil
+}
+
+// PostponePolling delays the next poll of the order until the given time
+func (s *Store) PostponePolling(ctx context.Context, number string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[number]; ok && j.nextAttempt.Before(until) {
+		j.nextAttempt = until
+	}
+
+	return nil
+}
+
+// RegisterEvent saves accrual event ID and returns false if the event has already been registered
+func (s *Store) RegisterEvent(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.events[id]; ok {
+		return false, nil
+	}
+
+	s.events[id] = time.Now()
+
+	return true, nil
+}
+
+// ForgetEvent removes accrual event ID so the event can be applied again
+func (s *Store) ForgetEvent(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.events, id)
+
+	return nil
+}
+
+// ExpireEvents removes accrual event IDs received before the given time
+func (s *Store) ExpireEvents(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, receivedAt := range s.events {
+		if receivedAt.Before(before) {
+			delete(s.events, id)
+		}
+	}
+
+	return nil
+}
+
+// MarkStale marks orders the accrual system failed to process in time as STALE
+// and removes them from the polling queue. Orders in final statuses are skipped.
+func (s *Store) MarkStale(ctx context.Context, numbers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for _, number := range numbers {
+		o, ok := s.orders[number]
+		if !ok || !s.statuses.Stale(o.status) {
+			continue
+		}
+
+		o.status = orders.StatusStale
+		s.history[o.number] = append(s.history[o.number], orders.Transition{Status: o.status, Accrual: o.accrual, At: now})
+
+		delete(s.jobs, o.number)
+	}
+
+	return nil
+}
+
+// UpdateStatuses stores new order statuses, credits processed orders to the ledger
+// and removes orders in final statuses from the polling queue.
+// Statuses the order cannot move to are logged and skipped.
+func (s *Store) UpdateStatuses(ctx context.Context, batch []orders.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for _, status := range batch {
+		o, ok := s.orders[status.Order]
+		if !ok {
+			continue
+		}
+
+		status, apply, err := s.statuses.Next(o.status, status)
+		if err != nil {
+			log.Printf("rejected status of order %v: %v\n", o.number, err)
+		}
+
+		if !apply {
+			if orders.IsFinal(o.status) {
+				delete(s.jobs, o.number)
+			}
+
+			continue
+		}
+
+		if o.status != status.Status || o.accrual != status.Accrual {
+			o.status = status.Status
+			o.accrual = status.Accrual
+			s.history[o.number] = append(s.history[o.number], orders.Transition{Status: o.status, Accrual: o.accrual, At: now})
+		}
+
+		if o.status == orders.StatusProcessed && o.accrual > 0 {
+			s.post(ledger.Accrual(o.customer, o.number, o.accrual, now))
+		}
+
+		if orders.IsFinal(o.status) {
+			delete(s.jobs, o.number)
+		}
+	}
+
+	return nil
+}
+
+// RejectedTransitions returns the number of order statuses rejected by the state machine
+func (s *Store) RejectedTransitions() uint64 {
+	return s.statuses.Rejected()
+}
+
+// UpdateBalances checks the ledger is balanced. Balances are always derived
+// from the ledger so there is no snapshot to refresh.
+func (s *Store) UpdateBalances(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !ledger.Balanced(s.entries) {
+		return fmt.Errorf("ledger is unbalanced")
+	}
+
+	return nil
+}
+
+// ReserveIdempotencyKey saves the key for the request with the given fingerprint and returns true,
+// or returns the record saved earlier and false if the key is already used.
+// Keys older than ttl are reserved again as if they were never used.
+func (s *Store) ReserveIdempotencyKey(ctx context.Context, userID, key, fingerprint string, ttl time.Duration) (idempotency.Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{userID, key}
+	now := time.Now()
+
+	if rec, ok := s.keys[k]; ok && !rec.createdAt.Before(now.Add(-ttl)) {
+		return rec.Record, false, nil
+	}
+
+	s.keys[k] = idempotencyRecord{Record: idempotency.Record{Fingerprint: fingerprint}, createdAt: now}
+
+	return idempotency.Record{}, true, nil
+}
+
+// CompleteIdempotencyKey saves the response to the request made with the key
+func (s *Store) CompleteIdempotencyKey(ctx context.Context, userID, key string, rec idempotency.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{userID, key}
+
+	saved, ok := s.keys[k]
+	if !ok {
+		return nil
+	}
+
+	saved.Completed = true
+	saved.Status = rec.Status
+	saved.ContentType = rec.ContentType
+	saved.Body = append([]byte(nil), rec.Body...)
+	s.keys[k] = saved
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes the key so the request can be retried
+func (s *Store) ReleaseIdempotencyKey(ctx context.Context, userID, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, idempotencyKey{userID, key})
+
+	return nil
+}
+
+// ExpireIdempotencyKeys removes keys saved before the given time
+func (s *Store) ExpireIdempotencyKeys(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, rec := range s.keys {
+		if rec.createdAt.Before(before) {
+			delete(s.keys, k)
+		}
+	}
+
+	return nil
+}
+
+// post appends entries to the ledger, entries already posted are skipped.
+// The caller must hold the lock.
+func (s *Store) post(entries []ledger.Entry) {
+	for _, e := range entries {
+		k := entryKey{e.Account, e.Kind, e.Reference}
+		if _, ok := s.posted[k]; ok {
+			continue
+		}
+
+		s.posted[k] = struct{}{}
+		s.entries = append(s.entries, e)
+	}
+}
+
+// CreateSession saves a new session of the user with the hash of its refresh token
+func (s *Store) CreateSession(ctx context.Context, userID, sessionID, refreshHash string, device session.Device, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[sessionID]; ok {
+		return fmt.Errorf("session %v already exists", sessionID)
+	}
+
+	now := time.Now()
+
+	s.sessions[sessionID] = &userSession{
+		customer:    userID,
+		refreshHash: refreshHash,
+		device:      device,
+		createdAt:   now,
+		lastSeenAt:  now,
+		expiresAt:   expiresAt,
+	}
+
+	return nil
+}
+
+// RotateRefreshToken replaces the current refresh token of the session and returns the session user ID and expiration time.
+// A refresh token that is not the current one has been used before, then the session is revoked.
+func (s *Store) RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string) (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	us, ok := s.sessions[sessionID]
+	if !ok {
+		return "", time.Time{}, storageerrs.ErrNoResults
+	}
+
+	now := time.Now()
+
+	if !us.revokedAt.IsZero() || !us.expiresAt.After(now) {
+		return "", time.Time{}, storageerrs.ErrSessionRevoked
+	}
+
+	if us.refreshHash != oldHash {
+		us.revokedAt = now
+
+		return "", time.Time{}, storageerrs.ErrTokenReused
+	}
+
+	us.refreshHash = newHash
+	us.lastSeenAt = now
+
+	return us.customer, us.expiresAt, nil
+}
+
+// RevokeSession revokes the session of the user, revoking it again is not an error
+func (s *Store) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	us, ok := s.sessions[sessionID]
+	if !ok || us.customer != userID {
+		return storageerrs.ErrNoResults
+	}
+
+	if us.revokedAt.IsZero() {
+		us.revokedAt = time.Now()
+	}
+
+	return nil
+}
+
+// RevokedSessions returns IDs of sessions revoked after the given time
+func (s *Store) RevokedSessions(ctx context.Context, since time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []string
+
+	for id, us := range s.sessions {
+		if us.revokedAt.After(since) {
+			res = append(res, id)
+		}
+	}
+
+	return res, nil
+}
+
+// LoadSessions returns sessions of the user that are neither revoked nor expired, recently used first
+func (s *Store) LoadSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var res []session.Session
+
+	for id, us := range s.sessions {
+		if us.customer != userID || !us.revokedAt.IsZero() || !us.expiresAt.After(now) {
+			continue
+		}
+
+		res = append(res, session.Session{
+			ID:         id,
+			UserAgent:  us.device.UserAgent,
+			IP:         us.device.IP,
+			CreatedAt:  us.createdAt,
+			LastSeenAt: us.lastSeenAt,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].LastSeenAt.Equal(res[j].LastSeenAt) {
+			return res[i].LastSeenAt.After(res[j].LastSeenAt)
+		}
+
+		return res[i].ID < res[j].ID
+	})
+
+	return res, nil
+}
+
+// RevokeOtherSessions revokes all sessions of the user but the given one and returns their IDs
+func (s *Store) RevokeOtherSessions(ctx context.Context, userID, keepID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var res []string
+
+	for id, us := range s.sessions {
+		if us.customer != userID || id == keepID || !us.revokedAt.IsZero() {
+			continue
+		}
+
+		us.revokedAt = now
+		res = append(res, id)
+	}
+
+	return res, nil
+}
+
+// TouchSessions saves the time sessions were last seen
+func (s *Store) TouchSessions(ctx context.Context, seen map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, at := range seen {
+		if us, ok := s.sessions[id]; ok && at.After(us.lastSeenAt) {
+			us.lastSeenAt = at
+		}
+	}
+
+	return nil
+}
+
+// LoginAttempts returns failed logins by the keys since the given time
+func (s *Store) LoginAttempts(ctx context.Context, keys []string, since time.Time) (map[string]auth.Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]auth.Attempts, len(keys))
+
+	for _, key := range keys {
+		if a, ok := s.attempts[key]; ok && !a.LastFailure.Before(since) {
+			res[key] = a
+		}
+	}
+
+	return res, nil
+}
+
+// RecordLoginFailure counts a failed login by the key, failures before the given time are forgotten
+func (s *Store) RecordLoginFailure(ctx context.Context, key string, since time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.attempts[key]
+	if a.LastFailure.Before(since) {
+		a.Failures = 0
+	}
+
+	a.Failures++
+	a.LastFailure = time.Now()
+	s.attempts[key] = a
+
+	return nil
+}
+
+// ResetLoginFailures forgets failed logins by the key
+func (s *Store) ResetLoginFailures(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package memstore
+
+import (
+	"testing"
+
+	"github.com/usa4ev/gophermart/internal/server"
+	"github.com/usa4ev/gophermart/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) server.Storage {
+		return New()
+	})
+}
@@ -0,0 +1,265 @@
+// Package migrate applies versioned database schema migrations embedded into the binary
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockKey is the advisory lock key held while migrating so only one replica migrates at a time
+const lockKey int64 = 0x6d696772
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+type (
+	// Migration is a pair of scripts stored as NNNN_name.up.sql and NNNN_name.down.sql
+	Migration struct {
+		Version int
+		Name    string
+		Up      string
+		Down    string
+	}
+
+	// Status tells if a migration has been applied
+	Status struct {
+		Version   int
+		Name      string
+		Applied   bool
+		AppliedAt time.Time
+	}
+)
+
+// Up applies all pending migrations
+func Up(ctx context.Context, db *sql.DB) error {
+	migrations, err := load(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	return locked(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			err := apply(ctx, conn, m.Up, "INSERT INTO schema_migrations(version, name, applied_at) VALUES ($1, $2, now())", m.Version, m.Name)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %04d_%v: %w", m.Version, m.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Down rolls back the given number of the latest applied migrations
+func Down(ctx context.Context, db *sql.DB, steps int) error {
+	migrations, err := load(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	return locked(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			err := apply(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("failed to roll back migration %04d_%v: %w", m.Version, m.Name, err)
+			}
+
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// List returns all known migrations with their statuses
+func List(ctx context.Context, db *sql.DB) ([]Status, error) {
+	migrations, err := load(migrationsFS)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+
+	err = locked(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			appliedAt, ok := applied[m.Version]
+			statuses = append(statuses, Status{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// locked runs f on a dedicated connection holding the migration lock
+func locked(ctx context.Context, db *sql.DB, f func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+				version integer PRIMARY KEY,
+				name varchar(256) not null,
+				applied_at timestamptz not null);`
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	return f(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// apply runs the script and records it in one transaction
+func apply(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// load reads migrations from fsys sorted by version
+func load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, file := range files {
+		base := path.Base(file)
+
+		var direction string
+
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %v is neither up nor down", base)
+		}
+
+		versionName := strings.SplitN(strings.TrimSuffix(base, "."+direction+".sql"), "_", 2)
+		if len(versionName) != 2 {
+			return nil, fmt.Errorf("migration %v name must be NNNN_name.%v.sql", base, direction)
+		}
+
+		version, err := strconv.Atoi(versionName[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %v has invalid version: %w", base, err)
+		}
+
+		script, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: versionName[1]}
+			byVersion[version] = m
+		} else if m.Name != versionName[1] {
+			return nil, fmt.Errorf("migrations %v and %v share version %v", m.Name, versionName[1], version)
+		}
+
+		if direction == "up" {
+			m.Up = string(script)
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%v must have both up and down scripts", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("embedded migrations", func(t *testing.T) {
+		migrations, err := load(migrationsFS)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version, "migration versions must be sequential")
+			assert.NotEmpty(t, m.Up)
+			assert.NotEmpty(t, m.Down)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		wantErr bool
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"migrations/0010_b.up.sql":   {Data: []byte("b")},
+				"migrations/0010_b.down.sql": {Data: []byte("b")},
+				"migrations/0002_a.up.sql":   {Data: []byte("a")},
+				"migrations/0002_a.down.sql": {Data: []byte("a")},
+			},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql": {Data: []byte("a")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "shared version",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql":   {Data: []byte("a")},
+				"migrations/0001_b.down.sql": {Data: []byte("b")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid version",
+			files: fstest.MapFS{
+				"migrations/first_a.up.sql":   {Data: []byte("a")},
+				"migrations/first_a.down.sql": {Data: []byte("a")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := load(tt.files)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, migrations, 2)
+			assert.Equal(t, Migration{Version: 2, Name: "a", Up: "a", Down: "a"}, migrations[0])
+			assert.Equal(t, Migration{Version: 10, Name: "b", Up: "b", Down: "b"}, migrations[1])
+		})
+	}
+}
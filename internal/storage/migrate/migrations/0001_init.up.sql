@@ -0,0 +1,32 @@
+-- IF NOT EXISTS lets databases created before migrations were introduced adopt this one
+CREATE TABLE IF NOT EXISTS users (
+    id VARCHAR(100) PRIMARY KEY,
+    username VARCHAR(256) not null,
+    pwdhash VARCHAR(256) not null);
+
+CREATE TABLE IF NOT EXISTS orders (
+    number VARCHAR(100) PRIMARY KEY UNIQUE,
+    ts timestamptz not null,
+    uploaded date not null,
+    customer varchar(100) not null,
+    income float not null,
+    status VARCHAR(30),
+    FOREIGN KEY (customer)
+        REFERENCES users (id));
+
+CREATE TABLE IF NOT EXISTS withdrawals (
+    number VARCHAR(100) PRIMARY KEY UNIQUE,
+    ts timestamptz not null,
+    processed date not null,
+    customer varchar(100) not null,
+    withdraw float not null,
+    FOREIGN KEY (customer)
+        REFERENCES users (id));
+
+CREATE TABLE IF NOT EXISTS balances (
+    customer varchar(100) primary key,
+    ts timestamptz not null,
+    balance float not null,
+    total_withdraw float not null,
+    FOREIGN KEY (customer)
+        REFERENCES users (id));
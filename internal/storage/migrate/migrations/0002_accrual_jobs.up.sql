@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS accrual_jobs (
+    number VARCHAR(100) PRIMARY KEY,
+    attempts integer not null default 0,
+    next_attempt_at timestamptz not null,
+    lease_owner varchar(100),
+    lease_until timestamptz,
+    FOREIGN KEY (number)
+        REFERENCES orders (number));
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_next_attempt_at ON accrual_jobs (next_attempt_at);
+
+-- orders stored before the job queue was introduced
+INSERT INTO accrual_jobs (number, next_attempt_at)
+    SELECT number, now() FROM orders WHERE status NOT IN ('INVALID','PROCESSED','STALE')
+ON CONFLICT (number) DO NOTHING;
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS accrual_events (
+    id VARCHAR(100) PRIMARY KEY,
+    received_at timestamptz not null);
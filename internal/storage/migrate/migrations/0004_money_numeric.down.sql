@@ -0,0 +1,4 @@
+ALTER TABLE orders ALTER COLUMN income TYPE float USING income::float;
+ALTER TABLE withdrawals ALTER COLUMN withdraw TYPE float USING withdraw::float;
+ALTER TABLE balances ALTER COLUMN balance TYPE float USING balance::float,
+    ALTER COLUMN total_withdraw TYPE float USING total_withdraw::float;
@@ -0,0 +1,5 @@
+-- float amounts drift when summed, NUMERIC keeps them exact
+ALTER TABLE orders ALTER COLUMN income TYPE numeric(20,2) USING round(income::numeric, 2);
+ALTER TABLE withdrawals ALTER COLUMN withdraw TYPE numeric(20,2) USING round(withdraw::numeric, 2);
+ALTER TABLE balances ALTER COLUMN balance TYPE numeric(20,2) USING round(balance::numeric, 2),
+    ALTER COLUMN total_withdraw TYPE numeric(20,2) USING round(total_withdraw::numeric, 2);
@@ -0,0 +1,27 @@
+-- append-only double-entry ledger, balances are derived from it
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id bigserial PRIMARY KEY,
+    account varchar(100) not null,
+    amount numeric(20,2) not null,
+    kind varchar(30) not null,
+    reference varchar(100) not null,
+    created_at timestamptz not null,
+    UNIQUE (account, kind, reference));
+
+CREATE INDEX IF NOT EXISTS ledger_entries_kind_reference_idx ON ledger_entries (kind, reference);
+
+INSERT INTO ledger_entries(account, amount, kind, reference, created_at)
+SELECT leg.account, leg.amount, 'ACCRUAL', o.number, o.ts
+FROM orders o CROSS JOIN LATERAL (VALUES (o.customer, o.income), ('system:accruals', -o.income)) AS leg (account, amount)
+WHERE o.status = 'PROCESSED' AND o.income > 0
+ON CONFLICT (account, kind, reference) DO NOTHING;
+
+INSERT INTO ledger_entries(account, amount, kind, reference, created_at)
+SELECT leg.account, leg.amount, 'WITHDRAWAL', w.number, w.ts
+FROM withdrawals w CROSS JOIN LATERAL (VALUES (w.customer, -w.withdraw), ('system:withdrawals', w.withdraw)) AS leg (account, amount)
+ON CONFLICT (account, kind, reference) DO NOTHING;
+
+UPDATE balances SET balance = agr.balance, total_withdraw = agr.withdrawn, ts = now()
+FROM (SELECT account, sum(amount) balance, COALESCE(-sum(amount) FILTER (WHERE kind = 'WITHDRAWAL'), 0) withdrawn
+      FROM ledger_entries GROUP BY account) AS agr
+WHERE agr.account = balances.customer;
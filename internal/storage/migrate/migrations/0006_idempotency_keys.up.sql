@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    customer varchar(100) not null,
+    key varchar(256) not null,
+    fingerprint varchar(64) not null,
+    status integer,
+    content_type varchar(256),
+    body bytea,
+    created_at timestamptz not null,
+    PRIMARY KEY (customer, key));
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
@@ -0,0 +1,22 @@
+-- usernames were only checked for uniqueness by the handler, concurrent registrations could duplicate them.
+-- AddUser relies on the index to report an existing user, so duplicates are resolved first: the first stored
+-- account keeps the name, the others are renamed to name#id and reported, their data is left intact.
+DO $$
+DECLARE
+    dup RECORD;
+    renamed VARCHAR(256);
+BEGIN
+    FOR dup IN
+        SELECT id, username FROM (
+            SELECT id, username, row_number() OVER (PARTITION BY username ORDER BY ctid) AS n FROM users
+        ) AS u WHERE n > 1
+    LOOP
+        renamed := left(dup.username, 255 - length(dup.id)) || '#' || dup.id;
+
+        UPDATE users SET username = renamed WHERE id = dup.id;
+
+        RAISE WARNING 'duplicate username "%" of user % is renamed to "%"', dup.username, dup.id, renamed;
+    END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_idx ON users (username);
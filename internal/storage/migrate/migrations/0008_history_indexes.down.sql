@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS orders_customer_ts_idx;
+DROP INDEX IF EXISTS withdrawals_customer_ts_idx;
@@ -0,0 +1,3 @@
+-- order and withdrawal history is paginated by (ts, number) per user
+CREATE INDEX IF NOT EXISTS orders_customer_ts_idx ON orders (customer, ts, number);
+CREATE INDEX IF NOT EXISTS withdrawals_customer_ts_idx ON withdrawals (customer, ts, number);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id bigserial PRIMARY KEY,
+    number varchar(100) not null,
+    status varchar(30) not null,
+    accrual numeric(20,2) not null,
+    changed_at timestamptz not null,
+    FOREIGN KEY (number)
+        REFERENCES orders (number));
+
+CREATE INDEX IF NOT EXISTS order_status_history_number_idx ON order_status_history (number, changed_at);
+
+-- the history of existing orders is unknown, keep the upload and the current status.
+-- ts was rewritten by status changes, so it is the upload time only if it falls on the upload date.
+INSERT INTO order_status_history(number, status, accrual, changed_at)
+SELECT number, 'NEW', 0, CASE WHEN ts::date = uploaded THEN ts ELSE uploaded::timestamptz END FROM orders;
+
+INSERT INTO order_status_history(number, status, accrual, changed_at)
+SELECT number, status, income, now() FROM orders WHERE status <> 'NEW';
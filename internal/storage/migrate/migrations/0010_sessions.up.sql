@@ -0,0 +1,13 @@
+-- a session is a family of rotated refresh tokens, only the hash of the current one is kept
+CREATE TABLE IF NOT EXISTS sessions (
+    id varchar(100) PRIMARY KEY,
+    customer varchar(100) not null,
+    refresh_hash varchar(64) not null,
+    created_at timestamptz not null,
+    refreshed_at timestamptz not null,
+    expires_at timestamptz not null,
+    revoked_at timestamptz,
+    FOREIGN KEY (customer)
+        REFERENCES users (id));
+
+CREATE INDEX IF NOT EXISTS sessions_revoked_at_idx ON sessions (revoked_at) WHERE revoked_at IS NOT NULL;
@@ -0,0 +1,9 @@
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent varchar(512) not null default '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip varchar(64) not null default '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen_at timestamptz;
+
+UPDATE sessions SET last_seen_at = refreshed_at WHERE last_seen_at IS NULL;
+
+ALTER TABLE sessions ALTER COLUMN last_seen_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS sessions_customer_idx ON sessions (customer);
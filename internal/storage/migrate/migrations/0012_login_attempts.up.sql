@@ -0,0 +1,5 @@
+-- failed logins by username ("user:...") and by client IP ("ip:...")
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key varchar(300) PRIMARY KEY,
+    failures int not null,
+    last_failure_at timestamptz not null);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS orders_customer_uploaded_at_idx;
+CREATE INDEX IF NOT EXISTS orders_customer_ts_idx ON orders (customer, ts, number);
+
+ALTER TABLE orders DROP COLUMN IF EXISTS uploaded_at;
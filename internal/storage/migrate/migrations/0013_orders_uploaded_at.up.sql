@@ -0,0 +1,16 @@
+-- orders.ts used to be rewritten with every status change, so it is not the upload time of processed orders.
+-- uploaded keeps the upload date: ts is kept if it falls on that date, otherwise the start of the date is used.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS uploaded_at timestamptz;
+
+UPDATE orders SET uploaded_at = CASE WHEN ts::date = uploaded THEN ts ELSE uploaded::timestamptz END
+WHERE uploaded_at IS NULL;
+
+ALTER TABLE orders ALTER COLUMN uploaded_at SET NOT NULL;
+
+-- the history of existing orders was started at ts as well
+UPDATE order_status_history h SET changed_at = o.uploaded_at
+FROM orders o
+WHERE h.number = o.number AND h.status = 'NEW' AND h.changed_at > o.uploaded_at;
+
+DROP INDEX IF EXISTS orders_customer_ts_idx;
+CREATE INDEX IF NOT EXISTS orders_customer_uploaded_at_idx ON orders (customer, uploaded_at, number);
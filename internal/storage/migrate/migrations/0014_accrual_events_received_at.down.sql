@@ -0,0 +1 @@
+DROP INDEX IF EXISTS accrual_events_received_at_idx;
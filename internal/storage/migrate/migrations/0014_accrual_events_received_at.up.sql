@@ -0,0 +1,2 @@
+-- accrual events are expired by receive time
+CREATE INDEX IF NOT EXISTS accrual_events_received_at_idx ON accrual_events(received_at);
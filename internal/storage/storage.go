@@ -1,12 +1,11 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
@@ -14,13 +13,19 @@ import (
 	_ "github.com/jackc/pgx/stdlib"
 
 	"github.com/usa4ev/gophermart/internal/auth"
+	"github.com/usa4ev/gophermart/internal/idempotency"
+	"github.com/usa4ev/gophermart/internal/ledger"
+	"github.com/usa4ev/gophermart/internal/money"
 	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/session"
+	"github.com/usa4ev/gophermart/internal/storage/migrate"
 	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
 )
 
 type (
 	Database struct {
 		*sql.DB
+		statuses *orders.StatusMachine
 	}
 )
 
@@ -30,80 +35,26 @@ func New(dsn string) (Database, error) {
 		err error
 	)
 
+	db.statuses = orders.NewStatusMachine()
+
 	db.DB, err = sql.Open("pgx", dsn)
 	if err != nil {
 		return db, fmt.Errorf("cannot connect to Database: %w", err)
 	}
 
-	err = db.initDB()
+	err = migrate.Up(context.Background(), db.DB)
 	if err != nil {
-		return db, fmt.Errorf("cannot init Database: %w", err)
+		return db, fmt.Errorf("cannot migrate Database: %w", err)
 	}
 
 	return db, nil
 }
 
-func (db Database) initDB() error {
-	query := `CREATE TABLE IF NOT EXISTS users (
-				id VARCHAR(100) PRIMARY KEY,
-				username VARCHAR(256) not null,
-                pwdhash VARCHAR(256) not null);`
-
-	_, err := db.Exec(query)
-	if err != nil {
-		return err
-	}
-
-	query = `CREATE TABLE IF NOT EXISTS orders (
-					number VARCHAR(100) PRIMARY KEY UNIQUE,
-					ts timestamptz not null,
-					uploaded date not null,
-					customer varchar(100) not null,
-					income float not null,
-					status VARCHAR(30),
-					FOREIGN KEY (customer)
-				REFERENCES users (id));`
-
-	_, err = db.Exec(query)
-	if err != nil {
-		return err
-	}
-
-	query = `CREATE TABLE IF NOT EXISTS withdrawals (
-					number VARCHAR(100) PRIMARY KEY UNIQUE,
-					ts timestamptz not null,
-					processed date not null,
-					customer varchar(100) not null,
-					withdraw float not null,
-					FOREIGN KEY (customer)
-				REFERENCES users (id));`
-
-	_, err = db.Exec(query)
-	if err != nil {
-		return err
-	}
-
-	query = `CREATE TABLE IF NOT EXISTS balances (
-					customer varchar(100) primary key,
-					ts timestamptz not null,
-					balance float not null,
-					total_withdraw float not null,
-					FOREIGN KEY (customer)
-				REFERENCES users (id));`
-
-	_, err = db.Exec(query)
-	if err != nil {
-		return err
-	}
-
-	return err
-}
-
 // AddUser adds new row to Database and return new user ID or error if addition failed
 func (db Database) AddUser(ctx context.Context, username, hash string) (string, error) {
 	id := uuid.New().String()
 
-	query := `INSERT INTO users(id, username, pwdhash) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING;`
+	query := `INSERT INTO users(id, username, pwdhash) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`
 
 	rowsAffected, err := db.execInsUpdStatement(ctx, query, id, username, hash)
 
@@ -158,6 +109,20 @@ func (db Database) GetPasswordHash(ctx context.Context, userName string) (string
 	return userID, hash, nil
 }
 
+// UpdatePasswordHash replaces the password hash of the user
+func (db Database) UpdatePasswordHash(ctx context.Context, userID, hash string) error {
+	query := "UPDATE users SET pwdhash = $2 WHERE id = $1"
+
+	rowsAffected, err := db.execInsUpdStatement(ctx, query, userID, hash)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	} else if rowsAffected == 0 {
+		return storageerrs.ErrNoResults
+	}
+
+	return nil
+}
+
 func (db Database) execInsUpdStatement(ctx context.Context, query string, args ...interface{}) (int64, error) {
 	tx, err := db.Begin()
 	if err != nil {
@@ -183,17 +148,28 @@ func (db Database) execInsUpdStatement(ctx context.Context, query string, args .
 	return affected, nil
 }
 
-func (db Database) StoreOrder(ctx context.Context, orderNum, userID string) error {
-	query := "INSERT INTO orders(number, customer, ts, uploaded, status, income) VALUES ($1, $2, now()::timestamptz, now(), 'NEW', 0) ON CONFLICT (number) DO NOTHING"
+// StoreOrder adds new order and puts it in the accrual polling queue to be polled from pollAt
+func (db Database) StoreOrder(ctx context.Context, orderNum, userID string, pollAt time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	rowsAffected, err := db.execInsUpdStatement(ctx, query, orderNum, userID)
+	query := "INSERT INTO orders(number, customer, ts, uploaded, uploaded_at, status, income) VALUES ($1, $2, now()::timestamptz, now(), now()::timestamptz, 'NEW', 0) ON CONFLICT (number) DO NOTHING"
 
+	res, err := tx.ExecContext(ctx, query, orderNum, userID)
 	if err != nil {
-		return err
+		return fmt.Errorf("error when executing query context %w", err)
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error when finding rows affected %w", err)
 	} else if rowsAffected == 0 {
 		query := "SELECT EXISTS(SELECT 1 FROM orders WHERE number = $1 AND customer = $2)"
 		exists := false
-		err := db.QueryRow(query, orderNum, userID).Scan(&exists)
+		err := db.QueryRowContext(ctx, query, orderNum, userID).Scan(&exists)
 
 		if exists {
 			return storageerrs.ErrOrderLoaded
@@ -204,21 +180,31 @@ func (db Database) StoreOrder(ctx context.Context, orderNum, userID string) erro
 		return storageerrs.ErrOrderExists
 	}
 
-	return nil
-}
+	query = "INSERT INTO order_status_history(number, status, accrual, changed_at) SELECT number, status, income, uploaded_at FROM orders WHERE number = $1"
+
+	_, err = tx.ExecContext(ctx, query, orderNum)
+	if err != nil {
+		return fmt.Errorf("failed to save order status history: %w", err)
+	}
 
-type order struct {
-	Number     string    `json:"number"`
-	Status     string    `json:"status"`
-	Accrual    float64   `json:"accrual,omitempty"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	query = "INSERT INTO accrual_jobs(number, next_attempt_at) VALUES ($1, $2::timestamptz) ON CONFLICT (number) DO NOTHING"
+
+	_, err = tx.ExecContext(ctx, query, orderNum, pollAt)
+	if err != nil {
+		return fmt.Errorf("failed to queue order for accrual polling: %w", err)
+	}
+
+	return tx.Commit()
 }
 
-func (db Database) LoadOrders(ctx context.Context, userID string) ([]byte, error) {
-	orderBatch := make([]order, 0)
-	query := "SELECT number, uploaded, income, status FROM orders WHERE customer = $1"
+// LoadOrders returns a page of the user's orders ordered by upload time
+func (db Database) LoadOrders(ctx context.Context, userID string, filter orders.Filter) ([]orders.Order, error) {
+	orderBatch := make([]orders.Order, 0)
 
-	rows, err := db.QueryContext(ctx, query, userID)
+	cond, tail, args := filterClauses(filter, userID, "uploaded_at")
+	query := "SELECT number, uploaded_at, income, status FROM orders WHERE " + cond + tail
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read orders from Database: %w", err)
 	}
@@ -226,7 +212,7 @@ func (db Database) LoadOrders(ctx context.Context, userID string) ([]byte, error
 	defer rows.Close()
 
 	for rows.Next() {
-		order := order{}
+		order := orders.Order{}
 
 		err := rows.Scan(&order.Number, &order.UploadedAt, &order.Accrual, &order.Status)
 		if err != nil {
@@ -236,62 +222,202 @@ func (db Database) LoadOrders(ctx context.Context, userID string) ([]byte, error
 		orderBatch = append(orderBatch, order)
 	}
 
-	buf := bytes.NewBuffer(nil)
-	enc := json.NewEncoder(buf)
+	return orderBatch, rows.Err()
+}
+
+// filterClauses returns WHERE conditions selecting the page of the user's items
+// ordered by (at, number) and the ORDER BY and LIMIT clauses with the query arguments
+func filterClauses(filter orders.Filter, userID, at string) (string, string, []interface{}) {
+	conds := []string{"customer = $1"}
+	args := []interface{}{userID}
+
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, 0, len(filter.Statuses))
+
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+			placeholders = append(placeholders, fmt.Sprintf("$%v", len(args)))
+		}
+
+		conds = append(conds, fmt.Sprintf("status IN (%s)", strings.Join(placeholders, ",")))
+	}
+
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conds = append(conds, fmt.Sprintf("%s >= $%v::timestamptz", at, len(args)))
+	}
+
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conds = append(conds, fmt.Sprintf("%s < $%v::timestamptz", at, len(args)))
+	}
+
+	direction, cmp := "ASC", ">"
+	if filter.Desc {
+		direction, cmp = "DESC", "<"
+	}
+
+	if filter.After != nil {
+		args = append(args, filter.After.At, filter.After.Number)
+		conds = append(conds, fmt.Sprintf("(%s, number) %s ($%v::timestamptz, $%v)", at, cmp, len(args)-1, len(args)))
+	}
+
+	tail := fmt.Sprintf(" ORDER BY %[1]s %[2]s, number %[2]s", at, direction)
 
-	if err = enc.Encode(orderBatch); err != nil {
-		return nil, fmt.Errorf("failed to encode orders: %w", err)
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		tail += fmt.Sprintf(" LIMIT $%v", len(args))
 	}
 
-	return buf.Bytes(), rows.Err()
+	return strings.Join(conds, " AND "), tail, args
 }
 
-func (db Database) LoadBalance(ctx context.Context, userID string) (float64, float64, error) {
-	query := `SELECT balances.balance + Sum(COALESCE(o.income, 0)) - Sum(COALESCE(w.withdraw,0)) balance,
-       		balances.total_withdraw + Sum(COALESCE(w.withdraw,0)) withdraw
-		FROM balances LEFT JOIN orders o ON o.customer = balances.customer AND o.ts > balances.ts
-					  LEFT JOIN withdrawals w ON w.customer = balances.customer AND w.ts > balances.ts
-		WHERE balances.customer = $1 GROUP BY balances.balance, balances.total_withdraw`
+// LoadOrder returns the user's order with its status history
+// or ErrNoResults if the user has no such order
+func (db Database) LoadOrder(ctx context.Context, userID, number string) (orders.Details, error) {
+	details := orders.Details{History: make([]orders.Transition, 0)}
 
-	rows, err := db.QueryContext(ctx, query, userID)
+	query := "SELECT number, uploaded_at, income, status FROM orders WHERE number = $1 AND customer = $2"
+
+	err := db.QueryRowContext(ctx, query, number, userID).Scan(&details.Number, &details.UploadedAt, &details.Accrual, &details.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return details, storageerrs.ErrNoResults
+	} else if err != nil {
+		return details, fmt.Errorf("failed to read order from Database: %w", err)
+	}
+
+	query = "SELECT status, accrual, changed_at FROM order_status_history WHERE number = $1 ORDER BY changed_at, id"
+
+	rows, err := db.QueryContext(ctx, query, number)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to read balance from Database: %w", err)
+		return details, fmt.Errorf("failed to read order status history from Database: %w", err)
 	}
 
 	defer rows.Close()
 
-	var total, withdrawn float64
-
 	for rows.Next() {
-		err := rows.Scan(&total, &withdrawn)
+		transition := orders.Transition{}
+
+		err := rows.Scan(&transition.Status, &transition.Accrual, &transition.At)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failed to scan values from batabase result: %w", err)
+			return details, fmt.Errorf("failed to scan values from batabase result: %w", err)
 		}
+
+		details.History = append(details.History, transition)
 	}
 
-	return total, withdrawn, rows.Err()
+	return details, rows.Err()
 }
 
-func (db Database) Withdraw(ctx context.Context, userID, number string, sum float64) error {
-	query := "INSERT INTO withdrawals(number, customer, withdraw, ts, processed) VALUES ($1, $2, $3, now()::timestamptz, now())"
+// LoadBalance returns the current balance of the user and the total withdrawn derived from the ledger
+func (db Database) LoadBalance(ctx context.Context, userID string) (money.Amount, money.Amount, error) {
+	query := `SELECT COALESCE(sum(amount), 0), COALESCE(-sum(amount) FILTER (WHERE kind = $2), 0)
+		FROM ledger_entries WHERE account = $1`
+
+	var total, withdrawn money.Amount
+
+	err := db.QueryRowContext(ctx, query, userID, ledger.KindWithdrawal).Scan(&total, &withdrawn)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read balance from Database: %w", err)
+	}
+
+	return total, withdrawn, nil
+}
 
-	rowsAffected, err := db.execInsUpdStatement(ctx, query, number, userID, sum)
+// Withdraw stores the withdrawal and posts it to the ledger in one transaction
+// or returns ErrInsufficientFunds if the balance is less than the sum.
+// The user's balances row is locked so concurrent withdrawals are checked one by one.
+func (db Database) Withdraw(ctx context.Context, userID, number string, sum money.Amount) error {
+	if sum <= 0 {
+		return storageerrs.ErrInvalidSum
+	}
 
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
+	}
+	defer tx.Rollback()
+
+	var locked int
+
+	query := "SELECT 1 FROM balances WHERE customer = $1 FOR UPDATE"
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storageerrs.ErrInsufficientFunds
+	} else if err != nil {
+		return fmt.Errorf("failed to lock balance: %w", err)
+	}
+
+	var total money.Amount
+
+	query = "SELECT COALESCE(sum(amount), 0) FROM ledger_entries WHERE account = $1"
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&total)
+	if err != nil {
+		return fmt.Errorf("failed to read balance from Database: %w", err)
+	}
+
+	if total < sum {
+		return storageerrs.ErrInsufficientFunds
+	}
+
+	query = "INSERT INTO withdrawals(number, customer, withdraw, ts, processed) VALUES ($1, $2, $3, now()::timestamptz, now())"
+
+	res, err := tx.ExecContext(ctx, query, number, userID, sum)
+	if err != nil {
+		return fmt.Errorf("error when executing query context %w", err)
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error when finding rows affected %w", err)
 	} else if rowsAffected == 0 {
 		return fmt.Errorf("no withdraws were added to Database for some reason")
 	}
 
+	err = postEntries(ctx, tx, ledger.Withdrawal(userID, number, sum, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postEntries appends entries to the ledger, entries already posted are skipped
+func postEntries(ctx context.Context, tx *sql.Tx, entries []ledger.Entry) error {
+	valueStrings := make([]string, 0, len(entries))
+	valueArgs := make([]interface{}, 0, len(entries)*5)
+
+	c := 1
+	for _, e := range entries {
+		valueStrings = append(valueStrings, fmt.Sprintf("($%v, $%v::numeric, $%v, $%v, $%v::timestamptz)", c, c+1, c+2, c+3, c+4))
+		valueArgs = append(valueArgs, e.Account, e.Amount, e.Kind, e.Reference, e.CreatedAt)
+		c += 5
+	}
+
+	query := fmt.Sprintf(`INSERT INTO ledger_entries(account, amount, kind, reference, created_at) VALUES %s
+			ON CONFLICT (account, kind, reference) DO NOTHING`,
+		strings.Join(valueStrings, ","))
+
+	_, err := tx.ExecContext(ctx, query, valueArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to post ledger entries: %w", err)
+	}
+
 	return nil
 }
 
-func (db Database) LoadWithdrawals(ctx context.Context, userID string) ([]byte, error) {
+// LoadWithdrawals returns a page of the user's withdrawals ordered by processing time
+func (db Database) LoadWithdrawals(ctx context.Context, userID string, filter orders.Filter) ([]orders.Withdrawal, error) {
 	withdrawals := make([]orders.Withdrawal, 0)
 
-	query := "SELECT number, withdraw, processed FROM withdrawals WHERE customer = $1 ORDER BY processed desc"
+	filter.Statuses = nil // withdrawals have no statuses
 
-	rows, err := db.QueryContext(ctx, query, userID)
+	cond, tail, args := filterClauses(filter, userID, "ts")
+	query := "SELECT number, withdraw, ts FROM withdrawals WHERE " + cond + tail
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read withdrawals from Database: %w", err)
 	}
@@ -309,87 +435,716 @@ func (db Database) LoadWithdrawals(ctx context.Context, userID string) ([]byte,
 		withdrawals = append(withdrawals, order)
 	}
 
-	buf := bytes.NewBuffer(nil)
-	enc := json.NewEncoder(buf)
-	err = enc.Encode(withdrawals)
+	return withdrawals, rows.Err()
+}
+
+// OrdersToProcess leases up to limit orders due to be polled for the given time.
+// Orders leased by other owners are skipped until their leases expire.
+func (db Database) OrdersToProcess(ctx context.Context, owner string, limit int, lease time.Duration) ([]orders.Job, error) {
+	jobs := make([]orders.Job, 0, limit)
+
+	query := `WITH leased AS (
+			UPDATE accrual_jobs SET lease_owner = $1, lease_until = now() + $3::float * interval '1 second'
+			WHERE number IN (
+				SELECT number FROM accrual_jobs
+				WHERE next_attempt_at <= now() AND (lease_until IS NULL OR lease_until < now())
+				ORDER BY next_attempt_at
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED)
+			RETURNING number, attempts)
+		SELECT o.number, o.status, leased.attempts, o.uploaded_at FROM orders o INNER JOIN leased ON leased.number = o.number`
+
+	rows, err := db.QueryContext(ctx, query, owner, limit, lease.Seconds())
+
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode withdrawals: %w", err)
+		return nil, fmt.Errorf("failed to lease orders from Database: %w", err)
 	}
 
-	return buf.Bytes(), rows.Err()
-}
+	defer rows.Close()
 
-func (db Database) OrdersToProcess(ctx context.Context) (map[string]string, error) {
-	ordersMap := make(map[string]string)
+	for rows.Next() {
+		job := orders.Job{}
+		err := rows.Scan(&job.Number, &job.Status, &job.Attempts, &job.UploadedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
 
-	query := "SELECT number, status FROM orders WHERE status NOT IN ('INVALID','PROCESSED')"
+		jobs = append(jobs, job)
+	}
 
-	rows, err := db.QueryContext(ctx, query)
+	return jobs, rows.Err()
+}
+
+// LoadStaleOrders returns orders the accrual system failed to process in time
+func (db Database) LoadStaleOrders(ctx context.Context) ([]orders.StaleOrder, error) {
+	orderBatch := make([]orders.StaleOrder, 0)
+	query := "SELECT number, customer, uploaded_at FROM orders WHERE status = 'STALE' ORDER BY uploaded_at"
 
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read orders from Database: %w", err)
+		return nil, fmt.Errorf("failed to read stale orders from Database: %w", err)
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
-		order := order{}
-		err := rows.Scan(&order.Number, &order.Status)
+		order := orders.StaleOrder{}
+
+		err := rows.Scan(&order.Number, &order.Customer, &order.UploadedAt)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
 		}
 
-		ordersMap[order.Number] = order.Status
+		orderBatch = append(orderBatch, order)
+	}
+
+	return orderBatch, rows.Err()
+}
+
+// RescheduleOrders releases orders leased by the owner and sets the time they are to be polled again
+func (db Database) RescheduleOrders(ctx context.Context, owner string, next map[string]time.Time) error {
+	if len(next) == 0 {
+		return nil
+	}
+
+	valueStrings := make([]string, 0, len(next))
+	valueArgs := make([]interface{}, 0, len(next)*2+1)
+	valueArgs = append(valueArgs, owner)
+
+	c := 2
+	for number, ts := range next {
+		valueStrings = append(valueStrings, fmt.Sprintf("($%v, $%v::timestamptz)", c, c+1))
+		valueArgs = append(valueArgs, number, ts)
+		c += 2
 	}
 
-	return ordersMap, rows.Err()
+	query := fmt.Sprintf(`UPDATE accrual_jobs SET attempts = attempts + 1, next_attempt_at = tmp.next_attempt_at,
+				lease_owner = NULL, lease_until = NULL
+			FROM (VALUES %s) as tmp (number, next_attempt_at)
+			WHERE accrual_jobs.number = tmp.number AND accrual_jobs.lease_owner = $1`,
+		strings.Join(valueStrings, ","))
+
+	_, err := db.execInsUpdStatement(ctx, query, valueArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule orders in Database: %w", err)
+	}
+
+	return nil
 }
 
+// PostponePolling delays the next poll of the order until the given time
+func (db Database) PostponePolling(ctx context.Context, number string, until time.Time) error {
+	query := "UPDATE accrual_jobs SET next_attempt_at = GREATEST(next_attempt_at, $2::timestamptz) WHERE number = $1"
+
+	_, err := db.execInsUpdStatement(ctx, query, number, until)
+	if err != nil {
+		return fmt.Errorf("failed to postpone order polling: %w", err)
+	}
+
+	return nil
+}
+
+// RegisterEvent saves accrual event ID and returns false if the event has already been registered
+func (db Database) RegisterEvent(ctx context.Context, id string) (bool, error) {
+	query := "INSERT INTO accrual_events(id, received_at) VALUES ($1, now()::timestamptz) ON CONFLICT (id) DO NOTHING"
+
+	rowsAffected, err := db.execInsUpdStatement(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to register accrual event: %w", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// ForgetEvent removes accrual event ID so the event can be applied again
+func (db Database) ForgetEvent(ctx context.Context, id string) error {
+	query := "DELETE FROM accrual_events WHERE id = $1"
+
+	_, err := db.execInsUpdStatement(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove accrual event: %w", err)
+	}
+
+	return nil
+}
+
+// ExpireEvents removes accrual event IDs received before the given time
+func (db Database) ExpireEvents(ctx context.Context, before time.Time) error {
+	query := "DELETE FROM accrual_events WHERE received_at < $1::timestamptz"
+
+	_, err := db.execInsUpdStatement(ctx, query, before)
+	if err != nil {
+		return fmt.Errorf("failed to expire accrual events: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateStatuses stores new order statuses, credits processed orders to the ledger
+// and removes orders in final statuses from the polling queue.
+// Statuses the order cannot move to are logged and skipped.
 func (db Database) UpdateStatuses(ctx context.Context, batch []orders.Status) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockStatuses(ctx, tx, batch)
+	if err != nil {
+		return err
+	}
+
+	batch = nextStatuses(db.statuses, current, batch)
+
+	if len(batch) > 0 {
+		err = applyStatuses(ctx, tx, batch)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dequeueFinal(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkStale marks orders the accrual system failed to process in time as STALE
+// and removes them from the polling queue. Orders in final statuses are skipped.
+func (db Database) MarkStale(ctx context.Context, numbers []string) error {
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	batch := make([]orders.Status, 0, len(numbers))
+	for _, number := range numbers {
+		batch = append(batch, orders.Status{Order: number, Status: orders.StatusStale})
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockStatuses(ctx, tx, batch)
+	if err != nil {
+		return err
+	}
+
+	stale := make([]orders.Status, 0, len(batch))
+
+	for _, status := range batch {
+		if cur, ok := current[status.Order]; ok && db.statuses.Stale(cur) {
+			stale = append(stale, status)
+		}
+	}
+
+	if len(stale) > 0 {
+		err = applyStatuses(ctx, tx, stale)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dequeueFinal(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// dequeueFinal removes orders in final statuses from the polling queue
+func dequeueFinal(ctx context.Context, tx *sql.Tx) error {
+	query := `DELETE FROM accrual_jobs USING orders
+			WHERE accrual_jobs.number = orders.number AND orders.status IN ('INVALID','PROCESSED','STALE')`
+
+	_, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to remove processed orders from polling queue: %w", err)
+	}
+
+	return nil
+}
+
+// lockStatuses returns current statuses of the batch orders locking them till the end of the transaction
+func lockStatuses(ctx context.Context, tx *sql.Tx, batch []orders.Status) (map[string]string, error) {
+	placeholders := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, len(batch))
+
+	for i, status := range batch {
+		placeholders = append(placeholders, fmt.Sprintf("$%v", i+1))
+		args = append(args, status.Order)
+	}
+
+	query := fmt.Sprintf(`SELECT number, status FROM orders WHERE number IN (%s) FOR UPDATE`,
+		strings.Join(placeholders, ","))
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock orders: %w", err)
+	}
+	defer rows.Close()
+
+	current := make(map[string]string, len(batch))
+
+	for rows.Next() {
+		var number, status string
+
+		err = rows.Scan(&number, &status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		current[number] = status
+	}
+
+	return current, rows.Err()
+}
+
+// nextStatuses validates the batch against current statuses of the orders.
+// It returns the last accepted status of every order, unknown orders are skipped.
+func nextStatuses(m *orders.StatusMachine, current map[string]string, batch []orders.Status) []orders.Status {
+	res := make([]orders.Status, 0, len(batch))
+	index := make(map[string]int, len(batch))
+
+	for _, status := range batch {
+		cur, ok := current[status.Order]
+		if !ok {
+			continue
+		}
+
+		next, apply, err := m.Next(cur, status)
+		if err != nil {
+			log.Printf("rejected status of order %v: %v\n", status.Order, err)
+
+			continue
+		}
+
+		if !apply {
+			continue
+		}
+
+		current[status.Order] = next.Status
+
+		if i, ok := index[next.Order]; ok {
+			res[i] = next
+		} else {
+			index[next.Order] = len(res)
+			res = append(res, next)
+		}
+	}
+
+	return res
+}
+
+// applyStatuses stores validated statuses with their history and credits processed orders to the ledger
+func applyStatuses(ctx context.Context, tx *sql.Tx, batch []orders.Status) error {
 	valueStrings := make([]string, 0, len(batch))
 	valueArgs := make([]interface{}, 0, len(batch)*2)
 
 	c := 1
 	for _, status := range batch {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%v, $%v::float, $%v)", c, c+1, c+2))
+		valueStrings = append(valueStrings, fmt.Sprintf("($%v, $%v::numeric, $%v)", c, c+1, c+2))
 		valueArgs = append(valueArgs, status.Order, status.Accrual, status.Status)
 		c += 3
 	}
 
-	query := fmt.Sprintf(`UPDATE orders SET status = tmp.status, income = tmp.income, ts = now()::timestamptz 
-              FROM (VALUES %s) as tmp (number, income, status) 
-			WHERE orders.number = tmp.number`,
+	// only changes make it to the history
+	query := fmt.Sprintf(`WITH changed AS (
+				UPDATE orders SET status = tmp.status, income = tmp.income
+				FROM (VALUES %s) as tmp (number, income, status)
+				WHERE orders.number = tmp.number AND (orders.status IS DISTINCT FROM tmp.status OR orders.income <> tmp.income)
+				RETURNING orders.number, orders.status, orders.income)
+			INSERT INTO order_status_history(number, status, accrual, changed_at)
+			SELECT number, status, income, now() FROM changed`,
 		strings.Join(valueStrings, ","))
 
-	_, err := db.execInsUpdStatement(ctx, query, valueArgs...)
+	_, err := tx.ExecContext(ctx, query, valueArgs...)
 	if err != nil {
 		return fmt.Errorf("failed to update statuses in Database: %w", err)
 	}
 
+	// credit processed orders, the same order is never credited twice
+	query = fmt.Sprintf(`INSERT INTO ledger_entries(account, amount, kind, reference, created_at)
+			SELECT leg.account, leg.amount, $%[2]v, o.number, now()
+			FROM orders o INNER JOIN (VALUES %[1]s) as tmp (number, income, status) ON tmp.number = o.number
+				CROSS JOIN LATERAL (VALUES (o.customer, o.income), ($%[3]v, -o.income)) AS leg (account, amount)
+			WHERE o.status = 'PROCESSED' AND o.income > 0
+			ON CONFLICT (account, kind, reference) DO NOTHING`,
+		strings.Join(valueStrings, ","), c, c+1)
+
+	_, err = tx.ExecContext(ctx, query, append(valueArgs, ledger.KindAccrual, ledger.AccountAccruals)...)
+	if err != nil {
+		return fmt.Errorf("failed to post accruals to ledger: %w", err)
+	}
+
 	return nil
 }
 
+// RejectedTransitions returns the number of order statuses rejected by the state machine
+func (db Database) RejectedTransitions() uint64 {
+	return db.statuses.Rejected()
+}
+
+// UpdateBalances checks the ledger is balanced and refreshes the balances snapshot from it
 func (db Database) UpdateBalances(ctx context.Context) error {
-	query := `WITH agr AS(
-			SELECT b.balance + sum(COALESCE(tmp.sum,0)) - sum(COALESCE(tmp.withdraw,0)) balance, b.total_withdraw + sum(COALESCE(tmp.withdraw,0)) total_withdraw,
-				   Max(COALESCE(tmp.ts, b.ts)) ts, b.customer
-		
-			FROM balances b LEFT JOIN
-				 (SELECT income sum, 0 withdraw, o.ts ts, o.customer customer
-				  FROM orders o INNER JOIN balances b on o.customer = b.customer AND o.ts > b.ts
-				  UNION
-				  SELECT 0, withdraw, w.ts, w.customer FROM withdrawals w INNER JOIN balances b on w.customer = b.customer AND w.ts > b.ts) tmp
-				 ON tmp.customer = b.customer
-			GROUP BY b.balance, b.total_withdraw, b.customer
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var kind, reference string
+
+	query := "SELECT kind, reference FROM ledger_entries GROUP BY kind, reference HAVING sum(amount) <> 0 LIMIT 1"
+
+	err = tx.QueryRowContext(ctx, query).Scan(&kind, &reference)
+	if err == nil {
+		return fmt.Errorf("ledger is unbalanced: %v entries of %v do not sum up to zero", kind, reference)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to check ledger: %w", err)
+	}
+
+	query = `UPDATE balances SET balance = agr.balance, total_withdraw = agr.withdrawn, ts = now()
+		FROM (SELECT account, sum(amount) balance, COALESCE(-sum(amount) FILTER (WHERE kind = $1), 0) withdrawn
+			  FROM ledger_entries GROUP BY account) AS agr
+		WHERE agr.account = balances.customer`
+
+	_, err = tx.ExecContext(ctx, query, ledger.KindWithdrawal)
+	if err != nil {
+		return fmt.Errorf("failed to update balances in Database: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ReserveIdempotencyKey saves the key for the request with the given fingerprint and returns true,
+// or returns the record saved earlier and false if the key is already used.
+// Keys older than ttl are reserved again as if they were never used.
+func (db Database) ReserveIdempotencyKey(ctx context.Context, userID, key, fingerprint string, ttl time.Duration) (idempotency.Record, bool, error) {
+	query := `INSERT INTO idempotency_keys(customer, key, fingerprint, created_at) VALUES ($1, $2, $3, now()::timestamptz)
+		ON CONFLICT (customer, key) DO UPDATE
+			SET fingerprint = EXCLUDED.fingerprint, status = NULL, content_type = NULL, body = NULL, created_at = EXCLUDED.created_at
+			WHERE idempotency_keys.created_at < now() - $4::float * interval '1 second'`
+
+	rowsAffected, err := db.execInsUpdStatement(ctx, query, userID, key, fingerprint, ttl.Seconds())
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	} else if rowsAffected > 0 {
+		return idempotency.Record{}, true, nil
+	}
+
+	var (
+		rec         idempotency.Record
+		status      sql.NullInt64
+		contentType sql.NullString
+	)
+
+	query = "SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE customer = $1 AND key = $2"
+
+	err = db.QueryRowContext(ctx, query, userID, key).Scan(&rec.Fingerprint, &status, &contentType, &rec.Body)
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+
+	rec.Completed = status.Valid
+	rec.Status = int(status.Int64)
+	rec.ContentType = contentType.String
+
+	return rec, false, nil
+}
+
+// CompleteIdempotencyKey saves the response to the request made with the key
+func (db Database) CompleteIdempotencyKey(ctx context.Context, userID, key string, rec idempotency.Record) error {
+	query := "UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5 WHERE customer = $1 AND key = $2"
+
+	_, err := db.execInsUpdStatement(ctx, query, userID, key, rec.Status, rec.ContentType, rec.Body)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes the key so the request can be retried
+func (db Database) ReleaseIdempotencyKey(ctx context.Context, userID, key string) error {
+	query := "DELETE FROM idempotency_keys WHERE customer = $1 AND key = $2"
+
+	_, err := db.execInsUpdStatement(ctx, query, userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// ExpireIdempotencyKeys removes keys saved before the given time
+func (db Database) ExpireIdempotencyKeys(ctx context.Context, before time.Time) error {
+	query := "DELETE FROM idempotency_keys WHERE created_at < $1::timestamptz"
+
+	_, err := db.execInsUpdStatement(ctx, query, before)
+	if err != nil {
+		return fmt.Errorf("failed to expire idempotency keys: %w", err)
+	}
+
+	return nil
+}
+
+// CreateSession saves a new session of the user with the hash of its refresh token
+func (db Database) CreateSession(ctx context.Context, userID, sessionID, refreshHash string, device session.Device, expiresAt time.Time) error {
+	query := `INSERT INTO sessions(id, customer, refresh_hash, user_agent, ip, created_at, refreshed_at, last_seen_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, now(), now(), now(), $6::timestamptz)`
+
+	_, err := db.execInsUpdStatement(ctx, query, sessionID, userID, refreshHash, device.UserAgent, device.IP, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+
+	return nil
+}
+
+// RotateRefreshToken replaces the current refresh token of the session and returns the session user ID and expiration time.
+// A refresh token that is not the current one has been used before, then the session is revoked
+// as the token might have been stolen.
+func (db Database) RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string) (string, time.Time, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID, hash string
+		expiresAt    time.Time
+		revokedAt    sql.NullTime
+	)
+
+	query := "SELECT customer, refresh_hash, expires_at, revoked_at FROM sessions WHERE id = $1 FOR UPDATE"
+
+	err = tx.QueryRowContext(ctx, query, sessionID).Scan(&userID, &hash, &expiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, storageerrs.ErrNoResults
+	} else if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get session from Database: %w", err)
+	}
+
+	if revokedAt.Valid || !expiresAt.After(time.Now()) {
+		return "", time.Time{}, storageerrs.ErrSessionRevoked
+	}
+
+	if hash != oldHash {
+		_, err = tx.ExecContext(ctx, "UPDATE sessions SET revoked_at = now() WHERE id = $1", sessionID)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to revoke session: %w", err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return "", time.Time{}, err
+		}
+
+		return "", time.Time{}, storageerrs.ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sessions SET refresh_hash = $2, refreshed_at = now(), last_seen_at = now() WHERE id = $1", sessionID, newHash)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	return userID, expiresAt, tx.Commit()
+}
+
+// RevokeSession revokes the session of the user, revoking it again is not an error
+func (db Database) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	query := "UPDATE sessions SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND customer = $2"
+
+	rowsAffected, err := db.execInsUpdStatement(ctx, query, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	} else if rowsAffected == 0 {
+		return storageerrs.ErrNoResults
+	}
+
+	return nil
+}
+
+// RevokedSessions returns IDs of sessions revoked after the given time
+func (db Database) RevokedSessions(ctx context.Context, since time.Time) ([]string, error) {
+	query := "SELECT id FROM sessions WHERE revoked_at > $1::timestamptz"
+
+	rows, err := db.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revoked sessions from Database: %w", err)
+	}
+	defer rows.Close()
+
+	var res []string
+
+	for rows.Next() {
+		var id string
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		res = append(res, id)
+	}
+
+	return res, rows.Err()
+}
+
+// LoadSessions returns sessions of the user that are neither revoked nor expired, recently used first
+func (db Database) LoadSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	query := `SELECT id, user_agent, ip, created_at, last_seen_at FROM sessions
+			WHERE customer = $1 AND revoked_at IS NULL AND expires_at > now()
+			ORDER BY last_seen_at DESC, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions from Database: %w", err)
+	}
+	defer rows.Close()
+
+	var res []session.Session
+
+	for rows.Next() {
+		var s session.Session
+
+		err = rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, rows.Err()
+}
+
+// RevokeOtherSessions revokes all sessions of the user but the given one and returns their IDs
+func (db Database) RevokeOtherSessions(ctx context.Context, userID, keepID string) ([]string, error) {
+	query := `UPDATE sessions SET revoked_at = now()
+			WHERE customer = $1 AND id <> $2 AND revoked_at IS NULL
+			RETURNING id`
+
+	rows, err := db.QueryContext(ctx, query, userID, keepID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var res []string
+
+	for rows.Next() {
+		var id string
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		res = append(res, id)
+	}
+
+	return res, rows.Err()
+}
+
+// TouchSessions saves the time sessions were last seen
+func (db Database) TouchSessions(ctx context.Context, seen map[string]time.Time) error {
+	if len(seen) == 0 {
+		return nil
+	}
+
+	valueStrings := make([]string, 0, len(seen))
+	valueArgs := make([]interface{}, 0, len(seen)*2)
+
+	c := 1
+	for id, at := range seen {
+		valueStrings = append(valueStrings, fmt.Sprintf("($%v, $%v::timestamptz)", c, c+1))
+		valueArgs = append(valueArgs, id, at)
+		c += 2
+	}
+
+	query := fmt.Sprintf(`UPDATE sessions SET last_seen_at = GREATEST(sessions.last_seen_at, tmp.seen)
+			FROM (VALUES %s) as tmp (id, seen)
+			WHERE sessions.id = tmp.id`,
+		strings.Join(valueStrings, ","))
+
+	_, err := db.execInsUpdStatement(ctx, query, valueArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to update sessions last seen time: %w", err)
+	}
+
+	return nil
+}
+
+// LoginAttempts returns failed logins by the keys since the given time
+func (db Database) LoginAttempts(ctx context.Context, keys []string, since time.Time) (map[string]auth.Attempts, error) {
+	placeholders := make([]string, 0, len(keys))
+	args := make([]interface{}, 0, len(keys)+1)
+
+	args = append(args, since)
+
+	for i, key := range keys {
+		placeholders = append(placeholders, fmt.Sprintf("$%v", i+2))
+		args = append(args, key)
+	}
+
+	query := fmt.Sprintf(`SELECT key, failures, last_failure_at FROM login_attempts
+			WHERE last_failure_at >= $1::timestamptz AND key IN (%s)`,
+		strings.Join(placeholders, ","))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login attempts from Database: %w", err)
+	}
+	defer rows.Close()
+
+	res := make(map[string]auth.Attempts, len(keys))
+
+	for rows.Next() {
+		var (
+			key string
+			a   auth.Attempts
 		)
-		UPDATE balances
-		SET balance = agr.balance, total_withdraw = agr.total_withdraw, ts = agr.ts
-		FROM agr
-		WHERE agr.customer = balances.customer`
 
-	_, err := db.execInsUpdStatement(ctx, query)
+		if err := rows.Scan(&key, &a.Failures, &a.LastFailure); err != nil {
+			return nil, fmt.Errorf("failed to scan values from batabase result: %w", err)
+		}
+
+		res[key] = a
+	}
+
+	return res, rows.Err()
+}
+
+// RecordLoginFailure counts a failed login by the key, failures before the given time are forgotten
+func (db Database) RecordLoginFailure(ctx context.Context, key string, since time.Time) error {
+	query := `INSERT INTO login_attempts(key, failures, last_failure_at) VALUES ($1, 1, now())
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN login_attempts.last_failure_at < $2::timestamptz THEN 1 ELSE login_attempts.failures + 1 END,
+				last_failure_at = now()`
+
+	_, err := db.execInsUpdStatement(ctx, query, key, since)
 	if err != nil {
-		return fmt.Errorf("failed to update statuses in Database: %w", err)
+		return fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	return nil
+}
+
+// ResetLoginFailures forgets failed logins by the key
+func (db Database) ResetLoginFailures(ctx context.Context, key string) error {
+	_, err := db.execInsUpdStatement(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	if err != nil {
+		return fmt.Errorf("failed to reset login failures: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/server"
+	"github.com/usa4ev/gophermart/internal/storage/storagetest"
+)
+
+// newTestDB connects to the database given by GOPHERMART_TEST_DSN or skips the test
+func newTestDB(t *testing.T) Database {
+	t.Helper()
+
+	dsn := os.Getenv("GOPHERMART_TEST_DSN")
+	if dsn == "" {
+		t.Skip("GOPHERMART_TEST_DSN is not set")
+	}
+
+	db, err := New(dsn)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	db := newTestDB(t)
+
+	storagetest.RunConformance(t, func(t *testing.T) server.Storage {
+		return db
+	})
+}
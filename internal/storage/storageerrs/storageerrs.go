@@ -6,4 +6,10 @@ var (
 	ErrNoResults   = fmt.Errorf("no rows found to match the request")
 	ErrOrderExists = fmt.Errorf("order already belongs other customer")
 	ErrOrderLoaded = fmt.Errorf("order already exists")
+
+	ErrInsufficientFunds = fmt.Errorf("not enough points on balance")
+	ErrInvalidSum        = fmt.Errorf("withdrawal sum must be positive")
+
+	ErrSessionRevoked = fmt.Errorf("session is revoked or expired")
+	ErrTokenReused    = fmt.Errorf("refresh token has already been used")
 )
@@ -0,0 +1,740 @@
+// Package storagetest validates storage backends against the behaviour the server relies on.
+// Every backend runs the same suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) server.Storage { return New() })
+//	}
+//
+// Tests may share the backend, so they use unique users and order numbers
+// and never assume the storage is empty.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/usa4ev/gophermart/internal/auth"
+	"github.com/usa4ev/gophermart/internal/idempotency"
+	"github.com/usa4ev/gophermart/internal/money"
+	"github.com/usa4ev/gophermart/internal/orders"
+	"github.com/usa4ev/gophermart/internal/server"
+	"github.com/usa4ev/gophermart/internal/session"
+	"github.com/usa4ev/gophermart/internal/storage/storageerrs"
+)
+
+// Factory returns the storage under test
+type Factory func(t *testing.T) server.Storage
+
+// RunConformance runs the suite against storages returned by newStorage
+func RunConformance(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s server.Storage)
+	}{
+		{"users", testUsers},
+		{"orders", testOrders},
+		{"statuses", testStatuses},
+		{"withdrawals", testWithdrawals},
+		{"history pages", testHistoryPages},
+		{"order status history", testOrderHistory},
+		{"status transitions", testStatusTransitions},
+		{"sessions", testSessions},
+		{"session devices", testSessionDevices},
+		{"login attempts", testLoginAttempts},
+		{"concurrent withdrawals", testConcurrentWithdrawals},
+		{"polling", testPolling},
+		{"stale orders", testStaleOrders},
+		{"events", testEvents},
+		{"idempotency keys", testIdempotencyKeys},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// newUser adds a user with a unique name
+func newUser(t *testing.T, s server.Storage) string {
+	t.Helper()
+
+	userID, err := s.AddUser(context.Background(), "user-"+uuid.NewString(), "hash")
+	require.NoError(t, err)
+
+	return userID
+}
+
+// newOrder stores an order with a unique number
+func newOrder(t *testing.T, s server.Storage, userID string) string {
+	t.Helper()
+
+	number := uuid.NewString()
+	require.NoError(t, s.StoreOrder(context.Background(), number, userID, time.Now()))
+
+	return number
+}
+
+// credit stores a processed order with the given accrual
+func credit(t *testing.T, s server.Storage, userID string, accrual money.Amount) string {
+	t.Helper()
+
+	number := newOrder(t, s, userID)
+	require.NoError(t, s.UpdateStatuses(context.Background(), []orders.Status{{Order: number, Status: orders.StatusProcessed, Accrual: accrual}}))
+
+	return number
+}
+
+func loadOrders(t *testing.T, s server.Storage, userID string) map[string]orders.Order {
+	t.Helper()
+
+	batch, err := s.LoadOrders(context.Background(), userID, orders.Filter{})
+	require.NoError(t, err)
+
+	res := make(map[string]orders.Order, len(batch))
+	for _, o := range batch {
+		res[o.Number] = o
+	}
+
+	return res
+}
+
+// leased leases all due orders and returns the ones among numbers
+func leased(t *testing.T, s server.Storage, owner string, numbers ...string) map[string]orders.Job {
+	t.Helper()
+
+	jobs, err := s.OrdersToProcess(context.Background(), owner, 10000, time.Minute)
+	require.NoError(t, err)
+
+	res := make(map[string]orders.Job)
+
+	for _, job := range jobs {
+		for _, number := range numbers {
+			if job.Number == number {
+				res[number] = job
+			}
+		}
+	}
+
+	return res
+}
+
+func testUsers(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	username := "user-" + uuid.NewString()
+
+	exists, err := s.UserExists(ctx, username)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	userID, hash, err := s.GetPasswordHash(ctx, username)
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+	assert.Empty(t, hash)
+
+	userID, err = s.AddUser(ctx, username, "hash")
+	require.NoError(t, err)
+	assert.NotEmpty(t, userID)
+
+	exists, err = s.UserExists(ctx, username)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	gotID, hash, err := s.GetPasswordHash(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, userID, gotID)
+	assert.Equal(t, "hash", hash)
+
+	_, err = s.AddUser(ctx, username, "other hash")
+	assert.ErrorIs(t, err, auth.ErrUserAlreadyExists)
+
+	require.NoError(t, s.UpdatePasswordHash(ctx, userID, "new hash"))
+
+	_, hash, err = s.GetPasswordHash(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, "new hash", hash)
+
+	assert.ErrorIs(t, s.UpdatePasswordHash(ctx, uuid.NewString(), "hash"), storageerrs.ErrNoResults)
+
+	total, withdrawn, err := s.LoadBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(0), total)
+	assert.Equal(t, money.Amount(0), withdrawn)
+}
+
+func testOrders(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	otherID := newUser(t, s)
+
+	assert.Empty(t, loadOrders(t, s, userID))
+
+	number := newOrder(t, s, userID)
+
+	assert.ErrorIs(t, s.StoreOrder(ctx, number, userID, time.Now()), storageerrs.ErrOrderLoaded)
+	assert.ErrorIs(t, s.StoreOrder(ctx, number, otherID, time.Now()), storageerrs.ErrOrderExists)
+
+	got := loadOrders(t, s, userID)
+	require.Len(t, got, 1)
+	assert.Equal(t, orders.StatusNew, got[number].Status)
+	assert.Equal(t, money.Amount(0), got[number].Accrual)
+	assert.WithinDuration(t, time.Now(), got[number].UploadedAt, 24*time.Hour)
+
+	assert.Empty(t, loadOrders(t, s, otherID))
+}
+
+func testStatuses(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+
+	processing := newOrder(t, s, userID)
+	processed := newOrder(t, s, userID)
+	invalid := newOrder(t, s, userID)
+
+	uploadedAt := loadOrders(t, s, userID)[processed].UploadedAt
+
+	err := s.UpdateStatuses(ctx, []orders.Status{
+		{Order: processing, Status: orders.StatusProcessing},
+		{Order: processed, Status: orders.StatusProcessed, Accrual: money.Amount(50050)},
+		{Order: invalid, Status: orders.StatusInvalid},
+		{Order: uuid.NewString(), Status: orders.StatusProcessed, Accrual: money.Points(1000)},
+	})
+	require.NoError(t, err)
+
+	got := loadOrders(t, s, userID)
+	assert.Equal(t, orders.StatusProcessing, got[processing].Status)
+	assert.Equal(t, orders.StatusProcessed, got[processed].Status)
+	assert.Equal(t, money.Amount(50050), got[processed].Accrual)
+	assert.Equal(t, orders.StatusInvalid, got[invalid].Status)
+	assert.True(t, uploadedAt.Equal(got[processed].UploadedAt), "upload time is changed by the status update")
+
+	// the same status delivered twice is credited once
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: processed, Status: orders.StatusProcessed, Accrual: money.Amount(50050)}}))
+
+	total, withdrawn, err := s.LoadBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(50050), total)
+	assert.Equal(t, money.Amount(0), withdrawn)
+
+	assert.NoError(t, s.UpdateBalances(ctx))
+
+	total, _, err = s.LoadBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(50050), total)
+}
+
+func testWithdrawals(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+
+	assert.ErrorIs(t, s.Withdraw(ctx, userID, uuid.NewString(), money.Amount(1)), storageerrs.ErrInsufficientFunds)
+
+	a, _ := money.Parse("0.1")
+	b, _ := money.Parse("0.2")
+	credit(t, s, userID, a)
+	credit(t, s, userID, b)
+
+	number := uuid.NewString()
+
+	// exactly the balance
+	sum, _ := money.Parse("0.3")
+	require.NoError(t, s.Withdraw(ctx, userID, number, sum))
+	assert.ErrorIs(t, s.Withdraw(ctx, userID, uuid.NewString(), money.Amount(1)), storageerrs.ErrInsufficientFunds)
+
+	credit(t, s, userID, money.Points(10))
+	assert.Error(t, s.Withdraw(ctx, userID, number, money.Amount(1)), "order is withdrawn twice")
+
+	// a negative sum would credit the user and a zero one records an empty withdrawal
+	assert.ErrorIs(t, s.Withdraw(ctx, userID, uuid.NewString(), money.Amount(-100)), storageerrs.ErrInvalidSum)
+	assert.ErrorIs(t, s.Withdraw(ctx, userID, uuid.NewString(), money.Amount(0)), storageerrs.ErrInvalidSum)
+
+	total, withdrawn, err := s.LoadBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.Points(10), total)
+	assert.Equal(t, sum, withdrawn)
+
+	withdrawals, err := s.LoadWithdrawals(ctx, userID, orders.Filter{})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, number, withdrawals[0].Order)
+	assert.Equal(t, sum, withdrawals[0].Sum)
+
+	withdrawals, err = s.LoadWithdrawals(ctx, newUser(t, s), orders.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, withdrawals)
+
+	assert.NoError(t, s.UpdateBalances(ctx))
+}
+
+func testConcurrentWithdrawals(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	credit(t, s, userID, money.Points(100))
+
+	const attempts = 50
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			err := s.Withdraw(ctx, userID, uuid.NewString(), money.Points(10))
+			if errors.Is(err, storageerrs.ErrInsufficientFunds) {
+				return
+			}
+
+			assert.NoError(t, err)
+
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	total, withdrawn, err := s.LoadBalance(ctx, userID)
+	require.NoError(t, err)
+
+	assert.Equal(t, 10, succeeded)
+	assert.Equal(t, money.Amount(0), total)
+	assert.Equal(t, money.Points(100), withdrawn)
+}
+
+func testPolling(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	owner, other := uuid.NewString(), uuid.NewString()
+
+	first := newOrder(t, s, userID)
+	second := newOrder(t, s, userID)
+	postponed := newOrder(t, s, userID)
+
+	// orders stored with a push window are not polled until it passes
+	pushed := uuid.NewString()
+	require.NoError(t, s.StoreOrder(ctx, pushed, userID, time.Now().Add(time.Hour)))
+
+	require.NoError(t, s.PostponePolling(ctx, postponed, time.Now().Add(time.Hour)))
+
+	jobs := leased(t, s, owner, first, second, postponed, pushed)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, orders.StatusNew, jobs[first].Status)
+	assert.Equal(t, 0, jobs[first].Attempts)
+	assert.WithinDuration(t, time.Now(), jobs[first].UploadedAt, 24*time.Hour)
+
+	// leased orders are skipped
+	assert.Empty(t, leased(t, s, other, first, second))
+
+	// orders are rescheduled only by the owner of the lease
+	require.NoError(t, s.RescheduleOrders(ctx, other, map[string]time.Time{first: time.Now().Add(-time.Second)}))
+	assert.Empty(t, leased(t, s, other, first))
+
+	require.NoError(t, s.RescheduleOrders(ctx, owner, map[string]time.Time{
+		first:  time.Now().Add(-time.Second),
+		second: time.Now().Add(time.Hour),
+	}))
+
+	// orders in final statuses leave the queue
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: first, Status: orders.StatusInvalid}}))
+	assert.Empty(t, leased(t, s, other, first, second))
+
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: second, Status: orders.StatusProcessing}}))
+	require.NoError(t, s.PostponePolling(ctx, second, time.Now().Add(-time.Hour)))
+	assert.Empty(t, leased(t, s, other, second), "polling is never moved earlier")
+}
+
+func testStaleOrders(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+
+	stale := newOrder(t, s, userID)
+	fresh := newOrder(t, s, userID)
+	processed := newOrder(t, s, userID)
+
+	// STALE is set by the service only, the accrual system can not report it
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: fresh, Status: orders.StatusStale}}))
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: processed, Status: orders.StatusProcessed}}))
+
+	require.NoError(t, s.MarkStale(ctx, []string{stale, processed, uuid.NewString()}))
+
+	got := loadOrders(t, s, userID)
+	assert.Equal(t, orders.StatusNew, got[fresh].Status)
+	assert.Equal(t, orders.StatusProcessed, got[processed].Status, "order in a final status is marked stale")
+
+	batch, err := s.LoadStaleOrders(ctx)
+	require.NoError(t, err)
+
+	numbers := make(map[string]string, len(batch))
+	for _, o := range batch {
+		numbers[o.Number] = o.Customer
+		assert.False(t, o.UploadedAt.IsZero(), "upload time of %v is not loaded", o.Number)
+	}
+
+	assert.Equal(t, userID, numbers[stale])
+	assert.NotContains(t, numbers, fresh)
+
+	assert.Empty(t, leased(t, s, uuid.NewString(), stale))
+}
+
+func testEvents(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	id := uuid.NewString()
+
+	registered, err := s.RegisterEvent(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, registered)
+
+	registered, err = s.RegisterEvent(ctx, id)
+	require.NoError(t, err)
+	assert.False(t, registered)
+
+	require.NoError(t, s.ForgetEvent(ctx, id))
+
+	registered, err = s.RegisterEvent(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, registered)
+
+	// events received after the retention window are kept
+	require.NoError(t, s.ExpireEvents(ctx, time.Now().Add(-time.Hour)))
+
+	registered, err = s.RegisterEvent(ctx, id)
+	require.NoError(t, err)
+	assert.False(t, registered)
+
+	require.NoError(t, s.ExpireEvents(ctx, time.Now().Add(time.Minute)))
+
+	registered, err = s.RegisterEvent(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, registered)
+}
+
+func testIdempotencyKeys(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	key := uuid.NewString()
+
+	_, reserved, err := s.ReserveIdempotencyKey(ctx, userID, key, "fp1", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	rec, reserved, err := s.ReserveIdempotencyKey(ctx, userID, key, "fp2", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, idempotency.Record{Fingerprint: "fp1"}, rec)
+
+	// keys are scoped by user
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, newUser(t, s), key, "fp1", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	want := idempotency.Record{Fingerprint: "fp1", Completed: true, Status: 200, ContentType: "application/json", Body: []byte(`{"ok":true}`)}
+	require.NoError(t, s.CompleteIdempotencyKey(ctx, userID, key, want))
+
+	rec, reserved, err = s.ReserveIdempotencyKey(ctx, userID, key, "fp1", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, want, rec)
+
+	require.NoError(t, s.ReleaseIdempotencyKey(ctx, userID, key))
+
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, userID, key, "fp1", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	require.NoError(t, s.ExpireIdempotencyKeys(ctx, time.Now().Add(time.Minute)))
+
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, userID, key, "fp3", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func testHistoryPages(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+
+	var numbers []string
+
+	for i := 0; i < 4; i++ {
+		numbers = append(numbers, credit(t, s, userID, money.Points(10)))
+	}
+
+	numbers = append(numbers, newOrder(t, s, userID))
+	require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{{Order: numbers[4], Status: orders.StatusInvalid}}))
+
+	// walk through all pages in both directions
+	for _, desc := range []bool{false, true} {
+		filter := orders.Filter{Limit: 2, Desc: desc}
+
+		var got []orders.Order
+
+		for {
+			page, err := s.LoadOrders(ctx, userID, filter)
+			require.NoError(t, err)
+
+			got = append(got, page...)
+
+			if len(page) < filter.Limit {
+				break
+			}
+
+			last := page[len(page)-1]
+			filter.After = &orders.Cursor{At: last.UploadedAt, Number: last.Number}
+		}
+
+		require.Len(t, got, 5)
+
+		for i := 1; i < len(got); i++ {
+			a, b := got[i-1], got[i]
+			if desc {
+				a, b = b, a
+			}
+
+			assert.True(t, orders.Less(a.UploadedAt, a.Number, b.UploadedAt, b.Number), "orders are not sorted")
+		}
+	}
+
+	page, err := s.LoadOrders(ctx, userID, orders.Filter{Statuses: []string{orders.StatusInvalid}})
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, numbers[4], page[0].Number)
+
+	page, err = s.LoadOrders(ctx, userID, orders.Filter{From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+
+	page, err = s.LoadOrders(ctx, userID, orders.Filter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Len(t, page, 5)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Withdraw(ctx, userID, uuid.NewString(), money.Points(1)))
+	}
+
+	withdrawals, err := s.LoadWithdrawals(ctx, userID, orders.Filter{Limit: 2, Desc: true})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+
+	last := withdrawals[1]
+	rest, err := s.LoadWithdrawals(ctx, userID, orders.Filter{Desc: true, After: &orders.Cursor{At: last.ProcessedAt, Number: last.Order}})
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	assert.NotContains(t, []string{withdrawals[0].Order, withdrawals[1].Order}, rest[0].Order)
+}
+
+func testOrderHistory(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	number := newOrder(t, s, userID)
+
+	_, err := s.LoadOrder(ctx, newUser(t, s), number)
+	assert.ErrorIs(t, err, storageerrs.ErrNoResults, "order of another user is found")
+
+	_, err = s.LoadOrder(ctx, userID, uuid.NewString())
+	assert.ErrorIs(t, err, storageerrs.ErrNoResults)
+
+	for _, status := range []orders.Status{
+		{Order: number, Status: orders.StatusProcessing},
+		{Order: number, Status: orders.StatusProcessing}, // repeated status is not a transition
+		{Order: number, Status: orders.StatusProcessed, Accrual: money.Amount(50050)},
+	} {
+		require.NoError(t, s.UpdateStatuses(ctx, []orders.Status{status}))
+	}
+
+	details, err := s.LoadOrder(ctx, userID, number)
+	require.NoError(t, err)
+	assert.Equal(t, number, details.Number)
+	assert.Equal(t, orders.StatusProcessed, details.Status)
+	assert.Equal(t, money.Amount(50050), details.Accrual)
+
+	require.Len(t, details.History, 3)
+	assert.Equal(t, orders.StatusNew, details.History[0].Status)
+	assert.Equal(t, orders.StatusProcessing, details.History[1].Status)
+	assert.Equal(t, orders.StatusProcessed, details.History[2].Status)
+	assert.Equal(t, money.Amount(50050), details.History[2].Accrual)
+
+	for i := 1; i < len(details.History); i++ {
+		assert.False(t, details.History[i].At.Before(details.History[i-1].At))
+	}
+}
+
+func testStatusTransitions(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+
+	registered := newOrder(t, s, userID)
+	processed := newOrder(t, s, userID)
+
+	rejected := s.RejectedTransitions()
+
+	err := s.UpdateStatuses(ctx, []orders.Status{
+		{Order: registered, Status: orders.AccrualRegistered},
+		{Order: processed, Status: orders.StatusProcessed, Accrual: money.Points(10)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rejected, s.RejectedTransitions())
+
+	// illegal transitions and unknown statuses are skipped, the rest of the batch is applied
+	err = s.UpdateStatuses(ctx, []orders.Status{
+		{Order: processed, Status: orders.StatusProcessing},
+		{Order: registered, Status: "DONE"},
+		{Order: registered, Status: orders.StatusProcessing},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rejected+2, s.RejectedTransitions())
+
+	got := loadOrders(t, s, userID)
+	assert.Equal(t, orders.StatusProcessing, got[registered].Status)
+	assert.Equal(t, orders.StatusProcessed, got[processed].Status)
+	assert.Equal(t, money.Points(10), got[processed].Accrual)
+
+	details, err := s.LoadOrder(ctx, userID, processed)
+	require.NoError(t, err)
+	require.Len(t, details.History, 2)
+	assert.Equal(t, orders.StatusProcessed, details.History[1].Status)
+}
+
+func testSessions(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	sessionID := uuid.NewString()
+	expiresAt := time.Now().Add(time.Hour)
+	since := time.Now().Add(-time.Second)
+
+	require.NoError(t, s.CreateSession(ctx, userID, sessionID, "hash1", session.Device{}, expiresAt))
+
+	got, gotExpiresAt, err := s.RotateRefreshToken(ctx, sessionID, "hash1", "hash2")
+	require.NoError(t, err)
+	assert.Equal(t, userID, got)
+	assert.WithinDuration(t, expiresAt, gotExpiresAt, time.Millisecond)
+
+	_, _, err = s.RotateRefreshToken(ctx, uuid.NewString(), "hash1", "hash2")
+	assert.ErrorIs(t, err, storageerrs.ErrNoResults)
+
+	revoked, err := s.RevokedSessions(ctx, since)
+	require.NoError(t, err)
+	assert.NotContains(t, revoked, sessionID)
+
+	// the rotated token is used again, the whole session is revoked
+	_, _, err = s.RotateRefreshToken(ctx, sessionID, "hash1", "hash3")
+	assert.ErrorIs(t, err, storageerrs.ErrTokenReused)
+
+	_, _, err = s.RotateRefreshToken(ctx, sessionID, "hash2", "hash3")
+	assert.ErrorIs(t, err, storageerrs.ErrSessionRevoked)
+
+	revoked, err = s.RevokedSessions(ctx, since)
+	require.NoError(t, err)
+	assert.Contains(t, revoked, sessionID)
+
+	// logout
+	loggedOut := uuid.NewString()
+	require.NoError(t, s.CreateSession(ctx, userID, loggedOut, "hash1", session.Device{}, expiresAt))
+
+	assert.ErrorIs(t, s.RevokeSession(ctx, newUser(t, s), loggedOut), storageerrs.ErrNoResults, "session of another user is revoked")
+	require.NoError(t, s.RevokeSession(ctx, userID, loggedOut))
+	require.NoError(t, s.RevokeSession(ctx, userID, loggedOut))
+
+	_, _, err = s.RotateRefreshToken(ctx, loggedOut, "hash1", "hash2")
+	assert.ErrorIs(t, err, storageerrs.ErrSessionRevoked)
+
+	revoked, err = s.RevokedSessions(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.NotContains(t, revoked, loggedOut)
+
+	// expired
+	expired := uuid.NewString()
+	require.NoError(t, s.CreateSession(ctx, userID, expired, "hash1", session.Device{}, time.Now().Add(-time.Second)))
+
+	_, _, err = s.RotateRefreshToken(ctx, expired, "hash1", "hash2")
+	assert.ErrorIs(t, err, storageerrs.ErrSessionRevoked)
+}
+
+func testSessionDevices(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	userID := newUser(t, s)
+	expiresAt := time.Now().Add(time.Hour)
+
+	phone, laptop, revoked := uuid.NewString(), uuid.NewString(), uuid.NewString()
+
+	require.NoError(t, s.CreateSession(ctx, userID, phone, "hash1", session.Device{UserAgent: "phone", IP: "10.0.0.1"}, expiresAt))
+	require.NoError(t, s.CreateSession(ctx, userID, laptop, "hash2", session.Device{UserAgent: "laptop", IP: "10.0.0.2"}, expiresAt))
+	require.NoError(t, s.CreateSession(ctx, userID, revoked, "hash3", session.Device{}, expiresAt))
+	require.NoError(t, s.CreateSession(ctx, newUser(t, s), uuid.NewString(), "hash4", session.Device{}, expiresAt))
+	require.NoError(t, s.RevokeSession(ctx, userID, revoked))
+
+	seen := time.Now().Add(time.Minute)
+	require.NoError(t, s.TouchSessions(ctx, map[string]time.Time{phone: seen}))
+	// an older time does not move last seen back
+	require.NoError(t, s.TouchSessions(ctx, map[string]time.Time{phone: seen.Add(-time.Hour)}))
+	require.NoError(t, s.TouchSessions(ctx, nil))
+
+	sessions, err := s.LoadSessions(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	assert.Equal(t, phone, sessions[0].ID, "recently used session goes first")
+	assert.Equal(t, "phone", sessions[0].UserAgent)
+	assert.Equal(t, "10.0.0.1", sessions[0].IP)
+	assert.WithinDuration(t, seen, sessions[0].LastSeenAt, time.Millisecond)
+	assert.False(t, sessions[0].CreatedAt.IsZero())
+	assert.Equal(t, laptop, sessions[1].ID)
+
+	others, err := s.RevokeOtherSessions(ctx, userID, laptop)
+	require.NoError(t, err)
+	assert.Equal(t, []string{phone}, others)
+
+	sessions, err = s.LoadSessions(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, laptop, sessions[0].ID)
+}
+
+func testLoginAttempts(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	user, ip := "user:"+uuid.NewString(), "ip:"+uuid.NewString()
+	since := time.Now().Add(-time.Hour)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.RecordLoginFailure(ctx, user, since))
+	}
+
+	require.NoError(t, s.RecordLoginFailure(ctx, ip, since))
+
+	got, err := s.LoginAttempts(ctx, []string{user, ip, "user:" + uuid.NewString()}, since)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, 3, got[user].Failures)
+	assert.Equal(t, 1, got[ip].Failures)
+	assert.WithinDuration(t, time.Now(), got[user].LastFailure, time.Minute)
+
+	// failures before since are forgotten
+	got, err = s.LoginAttempts(ctx, []string{user}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	require.NoError(t, s.RecordLoginFailure(ctx, user, time.Now().Add(time.Minute)))
+
+	got, err = s.LoginAttempts(ctx, []string{user}, since)
+	require.NoError(t, err)
+	assert.Equal(t, 1, got[user].Failures)
+
+	require.NoError(t, s.ResetLoginFailures(ctx, user))
+
+	got, err = s.LoginAttempts(ctx, []string{user, ip}, since)
+	require.NoError(t, err)
+	assert.NotContains(t, got, user)
+	assert.Equal(t, 1, got[ip].Failures)
+}